@@ -1,27 +1,392 @@
 package config
 
 import (
+	"fmt"
 	"log"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/spf13/viper"
 )
 
 type Config struct {
-	Server ServerConfig `mapstructure:"server"`
-	S3     S3Config     `mapstructure:"s3"`
+	Server     ServerConfig          `mapstructure:"server"`
+	Storage    StorageConfig         `mapstructure:"storage"`
+	S3         S3Config              `mapstructure:"s3"`
+	Filesystem FilesystemConfig      `mapstructure:"filesystem"`
+	Swift      SwiftConfig           `mapstructure:"swift"`
+	Origin     OriginConfig          `mapstructure:"origin"`
+	Admin      AdminConfig           `mapstructure:"admin"`
+	Resilience ResilienceConfig      `mapstructure:"resilience"`
+	Sweeper    SweeperConfig         `mapstructure:"sweeper"`
+	Usage      UsageConfig           `mapstructure:"usage"`
+	Thumbnails ThumbnailConfig       `mapstructure:"thumbnails"`
+	Timeouts   TimeoutConfig         `mapstructure:"timeouts"`
+	Wikis      map[string]WikiConfig `mapstructure:"wikis"`
 }
 
 type ServerConfig struct {
-	Port         string `mapstructure:"port"`
-	ReadTimeout  int    `mapstructure:"read_timeout"`
-	WriteTimeout int    `mapstructure:"write_timeout"`
+	// a full listen address such as ":8080" or "127.0.0.1:8080"
+	Address string `mapstructure:"address"`
+	// deprecated, use address; kept so that older configs keep working
+	Port string `mapstructure:"port"`
+	// a Unix domain socket to listen on as well as (or instead of) the address
+	Socket     string `mapstructure:"socket"`
+	SocketMode string `mapstructure:"socket_mode"`
+	// serve TLS on the address; the files are reloaded when they change
+	TLSCert string `mapstructure:"tls_cert"`
+	TLSKey  string `mapstructure:"tls_key"`
+	// accept cleartext HTTP/2 (h2c), for use behind a proxy that speaks it
+	H2C bool `mapstructure:"h2c"`
+
+	ReadTimeout       int `mapstructure:"read_timeout"`
+	WriteTimeout      int `mapstructure:"write_timeout"`
+	IdleTimeout       int `mapstructure:"idle_timeout"`
+	ReadHeaderTimeout int `mapstructure:"read_header_timeout"`
+	// seconds to keep serving after reporting that we aren't ready, so that the
+	// load balancer notices before we stop accepting connections
+	DrainDelay int `mapstructure:"drain_delay"`
+	// seconds to let in-flight requests and thumbnail uploads finish when shutting down
+	ShutdownGrace int `mapstructure:"shutdown_grace"`
+}
+
+// Get the TCP address to listen on, falling back to the old port setting, which
+// may or may not have a leading colon. Empty if we should only listen on the socket
+func (sc ServerConfig) ListenAddress() string {
+	if sc.Address != "" {
+		return sc.Address
+	}
+	if sc.Port == "" || strings.Contains(sc.Port, ":") {
+		return sc.Port
+	}
+	return ":" + sc.Port
+}
+
+// Whether TLS should be served on the TCP address
+func (sc ServerConfig) TLSEnabled() bool {
+	return sc.TLSCert != ""
+}
+
+// The storage backends that originals and thumbnails can be kept in
+const (
+	BackendS3         = "s3"
+	BackendMemory     = "memory"
+	BackendFilesystem = "filesystem"
+	BackendSwift      = "swift"
+)
+
+type StorageConfig struct {
+	// which backend to use, the settings for it are in its own section
+	Backend string `mapstructure:"backend"`
+	// a second backend that everything is also written to, and read from when this one fails
+	Replica ReplicaConfig `mapstructure:"replica"`
+}
+
+// A secondary backend, with its settings in its own sections under [storage.replica], ie
+// [storage.replica.s3] for a bucket in another region
+type ReplicaConfig struct {
+	// empty for no replica
+	Backend    string           `mapstructure:"backend"`
+	S3         S3Config         `mapstructure:"s3"`
+	Swift      SwiftConfig      `mapstructure:"swift"`
+	Filesystem FilesystemConfig `mapstructure:"filesystem"`
+	// milliseconds to wait for the primary before asking the replica as well and using whichever
+	// answers first; 0 to only use the replica when the primary fails
+	FailoverLatency int `mapstructure:"failover_latency"`
+}
+
+type FilesystemConfig struct {
+	// the upload directory ($wgUploadDirectory). A {wiki} in the path is replaced with the
+	// wiki name, for farms where each wiki has its own; otherwise each wiki is a directory in it
+	Root string `mapstructure:"root"`
+	// for a single wiki, the wiki whose upload directory the root is. Its files are then kept in
+	// the root itself rather than a directory named after it, and no other wiki has any
+	Wiki string `mapstructure:"wiki"`
+}
+
+// How to get a token for Swift
+const (
+	SwiftAuthKeystone = "keystone"
+	SwiftAuthTempAuth = "tempauth"
+)
+
+type SwiftConfig struct {
+	// "keystone" (v3) or "tempauth"
+	Auth string `mapstructure:"auth"`
+	// the Keystone v3 endpoint (ie https://keystone.example.com/v3), or the TempAuth
+	// endpoint (ie https://swift.example.com/auth/v1.0)
+	AuthURL string `mapstructure:"auth_url"`
+	// for TempAuth, the user is account:user
+	User     string `mapstructure:"user"`
+	Password string `mapstructure:"password"`
+	// Keystone only; the project to scope the token to, and where to find the object store
+	// in the catalog
+	UserDomain    string `mapstructure:"user_domain"`
+	Project       string `mapstructure:"project"`
+	ProjectDomain string `mapstructure:"project_domain"`
+	Region        string `mapstructure:"region"`
+	Interface     string `mapstructure:"interface"`
+	// use this storage URL instead of the one from the auth response
+	StorageURL string `mapstructure:"storage_url"`
+	// the container for each wiki and zone, the same as MediaWiki's SwiftFileBackend uses
+	Containers string `mapstructure:"containers"`
+}
+
+// A legacy upload server that originals missing from storage are fetched from, for the wikis
+// that turn it on, while they are being moved into storage
+type OriginConfig struct {
+	// the files are at this URL followed by the key (wiki/a/a0/Foo.png); a {wiki} in the
+	// URL is replaced with the wiki name instead, ie https://{wiki}.old.example.com/images
+	URL string `mapstructure:"url"`
+	// copy originals fetched from the origin into storage, so each file moves over the first time it's used
+	WriteBack bool `mapstructure:"write_back"`
+	// originals bigger than this many MB are served but not written back, since they are held
+	// in memory until they have been read to the end
+	WriteBackLimit int `mapstructure:"write_back_limit"`
+}
+
+// How failed storage calls are retried, and when a failing backend is left alone for a while
+type ResilienceConfig struct {
+	// how many times to retry a read, listing or delete that failed, on top of any retries
+	// the S3 SDK makes itself; thumbnail uploads have their own retries
+	Retries int `mapstructure:"retries"`
+	// milliseconds to wait before the first retry, doubling for each one after; the actual
+	// wait is a random amount up to this, so that instances don't all retry at once
+	RetryBackoff int `mapstructure:"retry_backoff"`
+	// how many failures in a row open a backend's circuit breaker, after which calls to it
+	// fail straight away; 0 turns the breaker off
+	BreakerThreshold int `mapstructure:"breaker_threshold"`
+	// seconds a breaker stays open before a call is let through to see if the backend is back
+	BreakerCooldown int `mapstructure:"breaker_cooldown"`
+	// keep serving thumbnails from the stale cache while the thumbnail backend's breaker is open
+	ServeStale bool `mapstructure:"serve_stale"`
+	// MB of recently used thumbnails to keep in memory for serve_stale
+	StaleCacheSize int `mapstructure:"stale_cache_size"`
+}
+
+// The background job that removes thumbnails whose original has gone
+type SweeperConfig struct {
+	// run the sweeper in the background; only turn this on for one instance
+	Enabled bool `mapstructure:"enabled"`
+	// the wikis to sweep
+	Wikis []string `mapstructure:"wikis"`
+	// hours to wait after finishing a sweep (or failing part of the way through) before the next
+	Interval int `mapstructure:"interval"`
+	// the most storage calls the sweeper makes a second; 0 for no limit
+	Rate int `mapstructure:"rate"`
+	// only log the orphans it finds, without removing them
+	DryRun bool `mapstructure:"dry_run"`
+	// move orphans to {wiki}/quarantine/ instead of deleting them
+	Quarantine bool `mapstructure:"quarantine"`
+	// where the sweeper remembers how far it has got, so that a restart carries on from there
+	CursorFile string `mapstructure:"cursor_file"`
+}
+
+// How the storage each wiki's thumbnails use is counted
+type UsageConfig struct {
+	// hours between listing every wiki's thumbnails to correct the counters, which are otherwise
+	// only kept up to date by what this instance does; 0 to never list them
+	ScanInterval int `mapstructure:"scan_interval"`
+	// wikis to list as well as the ones in [wikis] and any this instance has made thumbnails for
+	Wikis []string `mapstructure:"wikis"`
+}
+
+// The admin API, which is turned off unless a token is set
+type AdminConfig struct {
+	// admin requests must send this as "Authorization: Bearer <token>"
+	Token string `mapstructure:"token"`
+	// the widths a purge can regenerate straight away, ie the ones pages use the most
+	StandardWidths []int `mapstructure:"standard_widths"`
 }
 
 type S3Config struct {
-	Region    string `mapstructure:"region"`
-	Bucket    string `mapstructure:"bucket"`
+	Region string `mapstructure:"region"`
+	Bucket string `mapstructure:"bucket"`
+	// leave both empty to use the default credential chain (the environment,
+	// the shared config and credentials files, web identity or the instance role)
 	AccessKey string `mapstructure:"access_key"`
 	SecretKey string `mapstructure:"secret_key"`
+	// deprecated, use secret_key; the example config used to spell it this way
+	SecretAccessKey string `mapstructure:"secret_access_key"`
+	// for S3 compatible stores such as MinIO or Ceph RGW, ie https://minio.example.com:9000
+	Endpoint string `mapstructure:"endpoint"`
+	// address the bucket in the path (https://endpoint/bucket/key) rather than the
+	// hostname, which most S3 compatible stores need
+	PathStyle bool `mapstructure:"path_style"`
+	// verify the endpoint's certificate; only turn this off for testing. ca_file adds
+	// a CA to trust, ie for a store with a certificate from a private CA
+	TLSVerify bool   `mapstructure:"tls_verify"`
+	CAFile    string `mapstructure:"ca_file"`
+	// where and how thumbnails are written
+	Thumbnails S3ThumbnailConfig `mapstructure:"thumbnails"`
+}
+
+// The canned ACL that means don't send an ACL at all, for buckets with ACLs disabled
+const S3ACLNone = "none"
+
+// Where thumbnails are kept in S3, and what they are written with. By default they go in the
+// originals bucket, but they can be moved to their own bucket (or under a prefix) so that they
+// can have a different storage class or a lifecycle expiry without it touching the originals
+type S3ThumbnailConfig struct {
+	// defaults to the originals bucket
+	Bucket string `mapstructure:"bucket"`
+	// put in front of every thumbnail key, ie "thumbs/"
+	Prefix string `mapstructure:"prefix"`
+	// ie STANDARD_IA; empty for the bucket's default
+	StorageClass string `mapstructure:"storage_class"`
+	// a canned ACL, or "none"
+	ACL                string `mapstructure:"acl"`
+	CacheControl       string `mapstructure:"cache_control"`
+	ContentDisposition string `mapstructure:"content_disposition"`
+	// key=value pairs, as a list rather than a table as table keys lose their case
+	Tags []string `mapstructure:"tags"`
+}
+
+// Get the secret key, falling back to the old secret_access_key setting
+func (sc S3Config) Secret() string {
+	if sc.SecretKey != "" {
+		return sc.SecretKey
+	}
+	return sc.SecretAccessKey
+}
+
+// What to do when a thumbnail is requested at a width larger than the original
+const (
+	// return the original image, at its own size
+	OversizeOriginal = "original"
+	// redirect to the original image route
+	OversizeRedirect = "redirect"
+	// scale the original up to the requested width
+	OversizeUpscale = "upscale"
+	// refuse the request with a 400
+	OversizeReject = "reject"
+)
+
+// Settings that apply to thumbnails for every wiki, unless overridden in that wiki's section
+type ThumbnailConfig struct {
+	Oversize string `mapstructure:"oversize"`
+	// the widest a thumbnail may be when the oversize policy is upscale; anything wider than both
+	// this and the original is refused, as the width comes straight from the URL
+	MaxUpscaleWidth int `mapstructure:"max_upscale_width"`
+	// formats (in order of preference) to serve instead of the source's own format
+	// when the client's Accept header allows it; empty to disable negotiation
+	Formats []string `mapstructure:"formats"`
+	// ask browsers for the Sec-CH-DPR and Sec-CH-Width client hints, and use them to
+	// size thumbnails requested without a density suffix
+	ClientHints bool `mapstructure:"client_hints"`
+	// MB of thumbnails a wiki may have before new sizes stop being generated, and the
+	// nearest existing size is served instead; 0 for no quota
+	Quota int `mapstructure:"quota"`
+	// the most frames × width × height a GIF or WebP may have for its thumbnails to be animated,
+	// like MediaWiki's $wgMaxAnimatedGifArea; ones over it get a still of their first frame
+	MaxAnimatedArea int `mapstructure:"max_animated_area"`
+	// serve animated GIFs as animated WebPs to browsers that accept them, stored next to the GIF
+	// thumbnails as {width}px-{filename}.webp
+	GIFToWebP bool `mapstructure:"gif_to_webp"`
+}
+
+// The end-to-end time budget for generating a thumbnail, and how it is split between the
+// stages of a request. Each stage gets its percentage of the budget; they run one after the
+// other, so as long as the percentages add up to no more than 100 the whole pipeline fits
+// in the budget. The upload happens after the response has been sent, but is still given a share
+type TimeoutConfig struct {
+	// seconds
+	Budget  int `mapstructure:"budget"`
+	Head    int `mapstructure:"head"`
+	Get     int `mapstructure:"get"`
+	Process int `mapstructure:"process"`
+	Upload  int `mapstructure:"upload"`
+}
+
+// Get how long a stage may take, from its percentage of the budget
+func (tc TimeoutConfig) Stage(percent int) time.Duration {
+	return time.Duration(tc.Budget) * time.Second * time.Duration(percent) / 100
+}
+
+// Per-wiki overrides, keyed by the wiki name in the URL, ie [wikis.metawiki]
+type WikiConfig struct {
+	Oversize string `mapstructure:"oversize"`
+	// overrides [thumbnails] max_upscale_width; 0 inherits it
+	MaxUpscaleWidth int `mapstructure:"max_upscale_width"`
+	// nil inherits [thumbnails], an empty list disables negotiation for this wiki
+	Formats []string `mapstructure:"formats"`
+	// fetch originals that aren't in storage from the [origin] server
+	Origin bool `mapstructure:"origin"`
+	// overrides [thumbnails] quota; -1 for no quota
+	Quota int `mapstructure:"quota"`
+	// nil inherits [thumbnails]
+	GIFToWebP *bool `mapstructure:"gif_to_webp"`
+}
+
+// Formats that thumbnails can be negotiated to; these are the formats we can
+// encode that browsers advertise support for in their Accept header
+var NegotiableFormats = map[string]bool{
+	"webp": true,
+}
+
+// Get the oversize policy for a wiki, falling back to the global policy
+// and then to returning the original, which is what Thumbra has always done
+func (c *Config) OversizePolicy(wiki string) string {
+	if wc, ok := c.Wikis[strings.ToLower(wiki)]; ok && wc.Oversize != "" {
+		return wc.Oversize
+	}
+	if c.Thumbnails.Oversize != "" {
+		return c.Thumbnails.Oversize
+	}
+	return OversizeOriginal
+}
+
+// Get the widest a thumbnail may be upscaled to on a wiki, falling back to the global limit
+func (c *Config) MaxUpscaleWidth(wiki string) int {
+	if wc, ok := c.Wikis[strings.ToLower(wiki)]; ok && wc.MaxUpscaleWidth > 0 {
+		return wc.MaxUpscaleWidth
+	}
+	return c.Thumbnails.MaxUpscaleWidth
+}
+
+// Get the formats thumbnails may be negotiated to for a wiki, falling back to the global list
+func (c *Config) ThumbnailFormats(wiki string) []string {
+	if wc, ok := c.Wikis[strings.ToLower(wiki)]; ok && wc.Formats != nil {
+		return wc.Formats
+	}
+	return c.Thumbnails.Formats
+}
+
+// Whether a wiki's animated GIFs may be served as animated WebPs, falling back to the global setting
+func (c *Config) TranscodeGIF(wiki string) bool {
+	if wc, ok := c.Wikis[strings.ToLower(wiki)]; ok && wc.GIFToWebP != nil {
+		return *wc.GIFToWebP
+	}
+	return c.Thumbnails.GIFToWebP
+}
+
+// Get how many bytes of thumbnails a wiki may have, falling back to the global quota; 0 if there is no quota
+func (c *Config) ThumbnailQuota(wiki string) int64 {
+	quota := c.Thumbnails.Quota
+	if wc, ok := c.Wikis[strings.ToLower(wiki)]; ok && wc.Quota != 0 {
+		quota = wc.Quota
+	}
+	if quota < 0 {
+		return 0
+	}
+	return int64(quota) << 20
+}
+
+// Whether originals missing from storage should be fetched from the origin for a wiki
+func (c *Config) OriginEnabled(wiki string) bool {
+	return c.Origin.URL != "" && c.Wikis[strings.ToLower(wiki)].Origin
+}
+
+// Set the defaults for the backend sections, which are either at the top level or under the replica
+func setBackendDefaults(prefix string) {
+	viper.SetDefault(prefix+"s3.tls_verify", true)
+	viper.SetDefault(prefix+"s3.thumbnails.acl", "public-read")
+	viper.SetDefault(prefix+"swift.auth", SwiftAuthKeystone)
+	viper.SetDefault(prefix+"swift.user_domain", "Default")
+	viper.SetDefault(prefix+"swift.project_domain", "Default")
+	viper.SetDefault(prefix+"swift.interface", "public")
+	viper.SetDefault(prefix+"swift.containers", "{wiki}-local-{zone}")
 }
 
 func Load() *Config {
@@ -29,6 +394,30 @@ func Load() *Config {
 	viper.SetConfigType("toml")
 	viper.AddConfigPath(".")
 
+	viper.SetDefault("storage.backend", BackendS3)
+	setBackendDefaults("")
+	setBackendDefaults("storage.replica.")
+	viper.SetDefault("origin.write_back_limit", 100)
+	viper.SetDefault("sweeper.interval", 24)
+	viper.SetDefault("sweeper.rate", 50)
+	viper.SetDefault("resilience.retries", 2)
+	viper.SetDefault("resilience.retry_backoff", 100)
+	viper.SetDefault("resilience.breaker_threshold", 5)
+	viper.SetDefault("resilience.breaker_cooldown", 30)
+	viper.SetDefault("resilience.stale_cache_size", 256)
+	viper.SetDefault("thumbnails.max_animated_area", 12500000)
+	viper.SetDefault("thumbnails.max_upscale_width", 4096)
+	viper.SetDefault("server.socket_mode", "0660")
+	viper.SetDefault("server.idle_timeout", 120)
+	viper.SetDefault("server.read_header_timeout", 10)
+	viper.SetDefault("server.drain_delay", 5)
+	viper.SetDefault("server.shutdown_grace", 30)
+	viper.SetDefault("timeouts.budget", 30)
+	viper.SetDefault("timeouts.head", 10)
+	viper.SetDefault("timeouts.get", 40)
+	viper.SetDefault("timeouts.process", 30)
+	viper.SetDefault("timeouts.upload", 20)
+
 	if err := viper.ReadInConfig(); err != nil {
 		if _, ok := err.(viper.ConfigFileNotFoundError); ok {
 			log.Fatalln("No config file found")
@@ -44,5 +433,202 @@ func Load() *Config {
 		log.Fatalf("Unable to decode configuration into struct: %v", err)
 	}
 
+	if err := cfg.validate(); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+
 	return &cfg
 }
+
+// check the values that we can't express in the struct types
+func (c *Config) validate() error {
+	if err := c.Server.validate(); err != nil {
+		return fmt.Errorf("server: %w", err)
+	}
+	if err := validateBackend(c.Storage.Backend, c.S3, c.Swift, c.Filesystem); err != nil {
+		return err
+	}
+	if replica := c.Storage.Replica; replica.Backend != "" {
+		if err := validateBackend(replica.Backend, replica.S3, replica.Swift, replica.Filesystem); err != nil {
+			return fmt.Errorf("storage.replica: %w", err)
+		}
+	}
+	if err := validateOversize(c.Thumbnails.Oversize); err != nil {
+		return fmt.Errorf("thumbnails: %w", err)
+	}
+	if err := validateFormats(c.Thumbnails.Formats); err != nil {
+		return fmt.Errorf("thumbnails: %w", err)
+	}
+	if err := c.Timeouts.validate(); err != nil {
+		return fmt.Errorf("timeouts: %w", err)
+	}
+	if c.Usage.ScanInterval < 0 {
+		return fmt.Errorf("usage: scan_interval can't be negative")
+	}
+	if c.Thumbnails.Quota < 0 {
+		return fmt.Errorf("thumbnails: quota can't be negative")
+	}
+	if c.Thumbnails.MaxUpscaleWidth <= 0 {
+		return fmt.Errorf("thumbnails: max_upscale_width must be positive")
+	}
+	if c.Thumbnails.MaxAnimatedArea < 0 {
+		return fmt.Errorf("thumbnails: max_animated_area can't be negative")
+	}
+	if err := c.Sweeper.validate(); err != nil {
+		return fmt.Errorf("sweeper: %w", err)
+	}
+	if err := c.Resilience.validate(); err != nil {
+		return fmt.Errorf("resilience: %w", err)
+	}
+	for _, width := range c.Admin.StandardWidths {
+		if width <= 0 {
+			return fmt.Errorf("admin: standard width %d must be positive", width)
+		}
+	}
+	for name, wc := range c.Wikis {
+		if err := validateOversize(wc.Oversize); err != nil {
+			return fmt.Errorf("wikis.%s: %w", name, err)
+		}
+		if err := validateFormats(wc.Formats); err != nil {
+			return fmt.Errorf("wikis.%s: %w", name, err)
+		}
+		if wc.MaxUpscaleWidth < 0 {
+			return fmt.Errorf("wikis.%s: max_upscale_width can't be negative", name)
+		}
+		if wc.Quota < -1 {
+			return fmt.Errorf("wikis.%s: quota must be -1 (no quota) or more", name)
+		}
+		if wc.Origin && c.Origin.URL == "" {
+			return fmt.Errorf("wikis.%s: origin is turned on but [origin] has no url", name)
+		}
+	}
+	return nil
+}
+
+// check the settings of the backend that is in use
+func validateBackend(backend string, s3 S3Config, swift SwiftConfig, fs FilesystemConfig) error {
+	switch backend {
+	case BackendS3:
+		if err := s3.validate(); err != nil {
+			return fmt.Errorf("s3: %w", err)
+		}
+	case BackendSwift:
+		if err := swift.validate(); err != nil {
+			return fmt.Errorf("swift: %w", err)
+		}
+	case BackendFilesystem:
+		if fs.Root == "" {
+			return fmt.Errorf("filesystem: root must be set to use the filesystem backend")
+		}
+		if fs.Wiki != "" && strings.Contains(fs.Root, "{wiki}") {
+			return fmt.Errorf("filesystem: wiki can't be set when the root has a {wiki} in it")
+		}
+	case BackendMemory:
+	default:
+		return fmt.Errorf("unknown storage backend %q", backend)
+	}
+	return nil
+}
+
+func validateFormats(formats []string) error {
+	for _, format := range formats {
+		if !NegotiableFormats[format] {
+			return fmt.Errorf("format %q cannot be negotiated", format)
+		}
+	}
+	return nil
+}
+
+func validateOversize(policy string) error {
+	switch policy {
+	case "", OversizeOriginal, OversizeRedirect, OversizeUpscale, OversizeReject:
+		return nil
+	default:
+		return fmt.Errorf("unknown oversize policy %q", policy)
+	}
+}
+
+func (sc SweeperConfig) validate() error {
+	if sc.Rate < 0 {
+		return fmt.Errorf("rate can't be negative")
+	}
+	if sc.Enabled && len(sc.Wikis) == 0 {
+		return fmt.Errorf("wikis must be set to run the sweeper")
+	}
+	if sc.Enabled && sc.Interval <= 0 {
+		return fmt.Errorf("interval must be positive")
+	}
+	return nil
+}
+
+func (rc ResilienceConfig) validate() error {
+	if rc.Retries < 0 || rc.RetryBackoff < 0 || rc.BreakerThreshold < 0 || rc.BreakerCooldown < 0 || rc.StaleCacheSize < 0 {
+		return fmt.Errorf("settings can't be negative")
+	}
+	if rc.ServeStale && (rc.BreakerThreshold == 0 || rc.StaleCacheSize == 0) {
+		return fmt.Errorf("serve_stale needs the breaker and a stale_cache_size")
+	}
+	return nil
+}
+
+func (tc TimeoutConfig) validate() error {
+	if tc.Budget <= 0 {
+		return fmt.Errorf("budget must be positive")
+	}
+	for _, percent := range []int{tc.Head, tc.Get, tc.Process, tc.Upload} {
+		if percent <= 0 {
+			return fmt.Errorf("every stage needs a share of the budget")
+		}
+	}
+	if total := tc.Head + tc.Get + tc.Process + tc.Upload; total > 100 {
+		return fmt.Errorf("stages add up to %d%% of the budget", total)
+	}
+	return nil
+}
+
+func (sc S3Config) validate() error {
+	if sc.Bucket == "" {
+		return fmt.Errorf("bucket must be set")
+	}
+	if (sc.AccessKey == "") != (sc.Secret() == "") {
+		return fmt.Errorf("access_key and secret_key must be set together, or both left empty to use the default credential chain")
+	}
+	for _, tag := range sc.Thumbnails.Tags {
+		if key, _, ok := strings.Cut(tag, "="); !ok || key == "" {
+			return fmt.Errorf("thumbnails: tag %q is not key=value", tag)
+		}
+	}
+	return nil
+}
+
+func (sc SwiftConfig) validate() error {
+	if sc.Auth != SwiftAuthKeystone && sc.Auth != SwiftAuthTempAuth {
+		return fmt.Errorf("unknown auth %q", sc.Auth)
+	}
+	if sc.AuthURL == "" || sc.User == "" {
+		return fmt.Errorf("auth_url and user must be set")
+	}
+	if sc.Auth == SwiftAuthKeystone && sc.Project == "" {
+		return fmt.Errorf("project must be set for keystone")
+	}
+	if !strings.Contains(sc.Containers, "{wiki}") || !strings.Contains(sc.Containers, "{zone}") {
+		return fmt.Errorf("containers must include {wiki} and {zone}")
+	}
+	return nil
+}
+
+func (sc ServerConfig) validate() error {
+	if sc.ListenAddress() == "" && sc.Socket == "" {
+		return fmt.Errorf("either address or socket must be set")
+	}
+	if (sc.TLSCert == "") != (sc.TLSKey == "") {
+		return fmt.Errorf("tls_cert and tls_key must be set together")
+	}
+	if sc.TLSEnabled() && sc.ListenAddress() == "" {
+		return fmt.Errorf("tls_cert needs an address to serve TLS on")
+	}
+	if _, err := strconv.ParseUint(sc.SocketMode, 8, 32); err != nil {
+		return fmt.Errorf("socket_mode %q is not an octal file mode", sc.SocketMode)
+	}
+	return nil
+}
@@ -0,0 +1,190 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/telepedia/thumbra/models"
+	"github.com/telepedia/thumbra/services"
+	"github.com/telepedia/thumbra/utils"
+)
+
+// Endpoints for the people running Thumbra rather than for wikis. Every request must carry
+// the admin token from the config, and none of the responses may be cached
+type AdminHandler struct {
+	imageService *services.ImageService
+	token        string
+}
+
+func NewAdminHandler(imageService *services.ImageService) *AdminHandler {
+	return &AdminHandler{
+		imageService: imageService,
+		token:        imageService.AdminToken(),
+	}
+}
+
+// The response to a purge: the report, plus which file and revision it was for
+type purgeResponse struct {
+	Wiki     string `json:"wiki"`
+	Filename string `json:"filename"`
+	Revision string `json:"revision"`
+	*services.PurgeReport
+}
+
+// Delete the thumbnails of a file. The revision is "latest" (the default), an archived
+// revision's timestamp or "all", and regenerate=true makes the standard widths again after.
+// This is a POST rather than a DELETE since it can create thumbnails as well as remove them
+func (h *AdminHandler) ServePurge(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+
+	if !h.authorized(w, r) {
+		return
+	}
+
+	// the route doesn't limit the method, so that the method not allowed error is ours
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeProblem(w, r, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Only POST is supported.")
+		return
+	}
+
+	vars := mux.Vars(r)
+	req := models.ImageRequest{
+		Wiki:     vars["wiki"],
+		Hash1:    vars["hash1"],
+		Hash2:    vars["hash2"],
+		Filename: vars["filename"],
+		Revision: r.URL.Query().Get("revision"),
+	}
+	if req.Revision == "" {
+		req.Revision = "latest"
+	}
+	if err := utils.ValidateImageRequest(req); err != nil {
+		writeValidationError(w, r, err)
+		return
+	}
+
+	regenerate, ok := boolParam(w, r, "regenerate", false)
+	if !ok {
+		return
+	}
+
+	report, err := h.imageService.PurgeThumbnails(r.Context(), req, regenerate)
+	if err != nil {
+		writeInternalError(w, r, codeInternal, fmt.Errorf("purge stopped after removing %d thumbnails: %w", len(report.Removed), err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(purgeResponse{
+		Wiki:        req.Wiki,
+		Filename:    req.Filename,
+		Revision:    req.Revision,
+		PurgeReport: report,
+	})
+}
+
+// Look through a wiki's thumbnails for ones whose original has gone. This is a dry run unless
+// dry_run=false is passed, in which case they are removed (or quarantined, as the [sweeper]
+// config says). Up to limit thumbnails are looked at, and the report's next_cursor is passed
+// as cursor to carry on from where it stopped
+func (h *AdminHandler) ServeSweep(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+
+	if !h.authorized(w, r) {
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeProblem(w, r, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Only POST is supported.")
+		return
+	}
+
+	dryRun, ok := boolParam(w, r, "dry_run", true)
+	if !ok {
+		return
+	}
+
+	limit := services.SweepDefaultLimit
+	if value := r.URL.Query().Get("limit"); value != "" {
+		var err error
+		if limit, err = strconv.Atoi(value); err != nil || limit <= 0 || limit > services.SweepMaxLimit {
+			writeProblem(w, r, http.StatusBadRequest, codeInvalidParameter, fmt.Sprintf("limit must be between 1 and %d.", services.SweepMaxLimit))
+			return
+		}
+	}
+
+	report, err := h.imageService.SweepOrphans(r.Context(), mux.Vars(r)["wiki"], services.SweepOptions{
+		Cursor:     r.URL.Query().Get("cursor"),
+		Limit:      limit,
+		DryRun:     dryRun,
+		Quarantine: h.imageService.QuarantineOrphans(),
+	})
+	if err != nil {
+		writeInternalError(w, r, codeInternal, fmt.Errorf("sweep stopped at %q after %d orphans: %w", report.NextCursor, len(report.Orphans), err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(report)
+}
+
+// Show how much storage each wiki's thumbnails take up, and their quotas. These are the running
+// counts, so they are only as accurate as the last usage scan
+func (h *AdminHandler) ServeUsage(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+
+	if !h.authorized(w, r) {
+		return
+	}
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		writeProblem(w, r, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Only GET and HEAD are supported.")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if r.Method == http.MethodHead {
+		return
+	}
+	_ = json.NewEncoder(w).Encode(struct {
+		Wikis []services.WikiUsage `json:"wikis"`
+	}{h.imageService.Usage()})
+}
+
+// Read a true/false query parameter, telling the client off if it's something else
+func boolParam(w http.ResponseWriter, r *http.Request, name string, fallback bool) (bool, bool) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return fallback, true
+	}
+
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, codeInvalidParameter, name+" must be true or false.")
+		return false, false
+	}
+	return parsed, true
+}
+
+// Check the request has the admin token, telling the client off if it doesn't
+func (h *AdminHandler) authorized(w http.ResponseWriter, r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if ok && subtle.ConstantTimeCompare([]byte(token), []byte(h.token)) == 1 {
+		return true
+	}
+
+	w.Header().Set("WWW-Authenticate", `Bearer realm="thumbra"`)
+	writeProblem(w, r, http.StatusUnauthorized, codeUnauthorized, "A valid admin token is required.")
+	return false
+}
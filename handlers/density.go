@@ -0,0 +1,66 @@
+package handlers
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/telepedia/thumbra/utils"
+)
+
+// the highest pixel density we will scale a thumbnail for; no screen goes above this,
+// and it stops a URL (or header) asking for a thumbnail hundreds of times wider than requested
+const maxDensity = 4.0
+
+// the client hints we ask browsers to send when client hints are enabled
+var clientHints = []string{"Sec-CH-DPR", "Sec-CH-Width"}
+
+// Parse a density such as 2x or 1.5x
+func parseDensity(raw string) (float64, bool) {
+	density, err := strconv.ParseFloat(strings.TrimSuffix(raw, "x"), 64)
+	if err != nil || math.IsNaN(density) || density <= 0 || density > maxDensity {
+		return 0, false
+	}
+	return density, true
+}
+
+// Work out the real pixel width to generate for the {width} part of a scale-to-width route.
+// This is either a plain width, or a width with a density suffix such as 300@2x which is scaled
+// up to 600px. Without a suffix, the Sec-CH-DPR client hint is used instead if client hints are
+// enabled, and Sec-CH-Width can narrow the result down to the width of the slot the image is
+// displayed in (it never widens it). The result is a plain width, so it maps onto the usual
+// {width}px-{filename} thumbnail names
+func resolveWidth(w http.ResponseWriter, r *http.Request, raw string, hints bool) (string, error) {
+	widthStr, densityStr, hasDensity := strings.Cut(raw, "@")
+
+	width, err := strconv.Atoi(widthStr)
+	if err != nil || width <= 0 {
+		return "", utils.ErrInvalidWidth
+	}
+
+	density := 1.0
+	if hasDensity {
+		var ok bool
+		if density, ok = parseDensity(densityStr); !ok {
+			return "", utils.ErrInvalidWidth
+		}
+	} else if hints {
+		w.Header().Set("Accept-CH", strings.Join(clientHints, ", "))
+		addVary(w.Header(), clientHints...)
+
+		if dpr, ok := parseDensity(r.Header.Get("Sec-CH-DPR")); ok {
+			density = dpr
+		}
+	}
+
+	pixels := int(math.Round(float64(width) * density))
+
+	if hints && !hasDensity {
+		if slot, err := strconv.ParseFloat(r.Header.Get("Sec-CH-Width"), 64); err == nil && slot >= 1 {
+			pixels = min(pixels, int(math.Ceil(slot)))
+		}
+	}
+
+	return strconv.Itoa(max(pixels, 1)), nil
+}
@@ -0,0 +1,203 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/telepedia/thumbra/public"
+	"github.com/telepedia/thumbra/services"
+	"github.com/telepedia/thumbra/utils"
+)
+
+// Stable, machine readable codes for every error Thumbra returns. These are part of the
+// API: clients may rely on them, so existing codes must never be renamed or reused
+const (
+	codeInvalidWiki         = "invalid-wiki"
+	codeInvalidHash         = "invalid-hash"
+	codeInvalidFilename     = "invalid-filename"
+	codeInvalidRevision     = "invalid-revision"
+	codeInvalidWidth        = "invalid-width"
+	codeInvalidHeight       = "invalid-height"
+	codeInvalidRequest      = "invalid-request"
+	codeNotFound            = "not-found"
+	codeRouteNotFound       = "route-not-found"
+	codeMethodNotAllowed    = "method-not-allowed"
+	codeWidthTooLarge       = "width-too-large"
+	codeRangeNotSatisfiable = "range-not-satisfiable"
+	codeThumbnailFailed     = "thumbnail-failed"
+	codeOriginFailed        = "origin-failed"
+	codeStorageUnavailable  = "storage-unavailable"
+	codeQuotaExceeded       = "quota-exceeded"
+	codeUnauthorized        = "unauthorized"
+	codeInvalidParameter    = "invalid-parameter"
+	codeTimeout             = "timeout"
+	codeInternal            = "internal-error"
+)
+
+// An RFC 9457 problem details object. We don't publish documentation for each problem
+// type, so type is always about:blank (meaning the title is the HTTP status text) and
+// the problem is identified by the code extension member instead
+type problem struct {
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Status   int    `json:"status"`
+	Code     string `json:"code"`
+	Detail   string `json:"detail,omitempty"`
+	Instance string `json:"instance,omitempty"`
+}
+
+// Write an application/problem+json response. The detail is sent to the client as is,
+// so it must never contain internal error text - use writeInternalError for those
+func writeProblem(w http.ResponseWriter, r *http.Request, status int, code, detail string) {
+	// a bad request or a missing file may be cached for a while (the same as the
+	// placeholder), but failures on our side must not be
+	if status >= http.StatusInternalServerError {
+		w.Header().Set("Cache-Control", "no-store")
+	} else if w.Header().Get("Cache-Control") == "" && (status == http.StatusNotFound || status == http.StatusBadRequest) {
+		w.Header().Set("Cache-Control", "public, max-age=3600")
+	}
+
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.Header().Del("Content-Length")
+	w.WriteHeader(status)
+
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	_ = json.NewEncoder(w).Encode(problem{
+		Type:     "about:blank",
+		Title:    http.StatusText(status),
+		Status:   status,
+		Code:     code,
+		Detail:   detail,
+		Instance: r.URL.Path,
+	})
+}
+
+// Log an unexpected error and tell the client something went wrong, without telling them what.
+// If a stage of the request ran out of time the client is told that instead, and if the client
+// has already gone away there is nobody to tell
+func writeInternalError(w http.ResponseWriter, r *http.Request, code string, err error) {
+	if r.Context().Err() != nil {
+		log.Printf("%s %s: client went away: %v", r.Method, r.URL.Path, err)
+		return
+	}
+
+	log.Printf("%s %s: %s: %v", r.Method, r.URL.Path, code, err)
+
+	if errors.Is(err, context.DeadlineExceeded) {
+		writeProblem(w, r, http.StatusGatewayTimeout, codeTimeout, "The request took too long, please try again later.")
+		return
+	}
+
+	// the file probably exists, we just couldn't get it from where it is being migrated from
+	if errors.Is(err, services.ErrOriginUnavailable) {
+		writeProblem(w, r, http.StatusBadGateway, codeOriginFailed, "The file could not be fetched, please try again later.")
+		return
+	}
+
+	// storage is having an outage, and we are giving it a rest
+	if errors.Is(err, services.ErrStorageUnavailable) {
+		writeProblem(w, r, http.StatusServiceUnavailable, codeStorageUnavailable, "Storage is unavailable, please try again later.")
+		return
+	}
+
+	writeProblem(w, r, http.StatusInternalServerError, code, "An error occurred, please try again later.")
+}
+
+// Tell the client that their request was malformed. Validation errors are our own
+// messages, so they are safe to send as the detail. Anything we don't have a code for
+// gets the generic invalid-request, rather than being blamed on a part of the URL
+func writeValidationError(w http.ResponseWriter, r *http.Request, err error) {
+	var code string
+	switch {
+	case errors.Is(err, utils.ErrInvalidWiki):
+		code = codeInvalidWiki
+	case errors.Is(err, utils.ErrInvalidHash):
+		code = codeInvalidHash
+	case errors.Is(err, utils.ErrInvalidFileName):
+		code = codeInvalidFilename
+	case errors.Is(err, utils.ErrInvalidRevision):
+		code = codeInvalidRevision
+	case errors.Is(err, utils.ErrInvalidWidth):
+		code = codeInvalidWidth
+	case errors.Is(err, utils.ErrInvalidHeight):
+		code = codeInvalidHeight
+	default:
+		code = codeInvalidRequest
+	}
+	writeProblem(w, r, http.StatusBadRequest, code, err.Error())
+}
+
+// Tell the client the file doesn't exist. An <img> gets the placeholder image so that
+// pages don't show a broken image; anything else gets a problem document
+func writeNotFound(w http.ResponseWriter, r *http.Request) {
+	addVary(w.Header(), "Accept", "Sec-Fetch-Dest")
+
+	if wantsImage(r) {
+		writePlaceholderResponse(w, r)
+		return
+	}
+
+	writeProblem(w, r, http.StatusNotFound, codeNotFound, "The requested file does not exist.")
+}
+
+func writePlaceholderResponse(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "image/webp")
+	w.Header().Set("Content-Length", strconv.Itoa(len(public.PlaceholderData)))
+	// cache these for an hour
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	w.WriteHeader(http.StatusNotFound)
+	if r.Method == http.MethodHead {
+		return
+	}
+	_, _ = w.Write(public.PlaceholderData)
+}
+
+// Work out whether the request came from an <img> (or similar) that will display whatever we
+// send back. Browsers tell us directly with Sec-Fetch-Dest; for anything that doesn't send it we
+// fall back to whether the Accept header asks for images rather than documents
+func wantsImage(r *http.Request) bool {
+	if dest := r.Header.Get("Sec-Fetch-Dest"); dest != "" {
+		return dest == "image"
+	}
+
+	accept := r.Header.Get("Accept")
+	return strings.Contains(accept, "image/") &&
+		!strings.Contains(accept, "text/html") &&
+		!strings.Contains(accept, "json")
+}
+
+// Add fields to the Vary header, skipping any that are already there
+func addVary(h http.Header, fields ...string) {
+	existing := make(map[string]bool)
+	for _, value := range h.Values("Vary") {
+		for _, field := range strings.Split(value, ",") {
+			existing[strings.ToLower(strings.TrimSpace(field))] = true
+		}
+	}
+
+	for _, field := range fields {
+		if !existing[strings.ToLower(field)] {
+			h.Add("Vary", field)
+			existing[strings.ToLower(field)] = true
+		}
+	}
+}
+
+// Used by the router for paths that don't match any route
+func serveRouteNotFound(w http.ResponseWriter, r *http.Request) {
+	writeProblem(w, r, http.StatusNotFound, codeRouteNotFound, "No route matches the requested path.")
+}
+
+// Used by the router for routes that exist but not for the request method
+func serveMethodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Allow", "GET, HEAD, OPTIONS")
+	writeProblem(w, r, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Only GET, HEAD and OPTIONS are supported.")
+}
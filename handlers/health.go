@@ -0,0 +1,36 @@
+package handlers
+
+import (
+	"net/http"
+	"sync/atomic"
+)
+
+// Whether this instance should be sent traffic. It starts out ready, and is flipped when we
+// begin shutting down so that the load balancer stops sending us new requests while we drain
+type Readiness struct {
+	draining atomic.Bool
+}
+
+func NewReadiness() *Readiness {
+	return &Readiness{}
+}
+
+// Mark this instance as shutting down; it can't be undone
+func (rd *Readiness) Drain() {
+	rd.draining.Store(true)
+}
+
+// Report whether we are ready to the load balancer, 200 if so and 503 if we are draining
+func (rd *Readiness) ServeReady(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+
+	if rd.draining.Load() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = w.Write([]byte("draining\n"))
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte("ready\n"))
+}
@@ -1,50 +1,32 @@
 package handlers
 
 import (
-	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 	"log"
 	"net/http"
-	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
 
 	"github.com/gorilla/mux"
+	"github.com/telepedia/thumbra/config"
 	"github.com/telepedia/thumbra/models"
-	"github.com/telepedia/thumbra/public"
 	"github.com/telepedia/thumbra/services"
-	"github.com/telepedia/thumbra/storage"
 	"github.com/telepedia/thumbra/utils"
 )
 
 type ImageHandler struct {
-	s3Client     *storage.S3Client
 	imageService *services.ImageService
 }
 
-func NewImageHandler(s3Client *storage.S3Client) *ImageHandler {
+func NewImageHandler(imageService *services.ImageService) *ImageHandler {
 	return &ImageHandler{
-		s3Client:     s3Client,
-		imageService: services.NewImageService(s3Client),
+		imageService: imageService,
 	}
 }
 
-var placeholderImage = &models.ImageResponse{
-	ContentType: "image/webp",
-	Data:        public.PlaceholderData,
-	Length:      int64(len(public.PlaceholderData)),
-}
-
-func writePlaceholderResponse(w http.ResponseWriter) {
-	w.Header().Set("Content-Type", placeholderImage.ContentType)
-	w.Header().Set("Content-Length", strconv.FormatInt(placeholderImage.Length, 10))
-	// cache these for an hour
-	w.Header().Set("Cache-Control", "public, max-age=3600")
-	w.WriteHeader(http.StatusNotFound)
-	_, _ = w.Write(placeholderImage.Data)
-}
-
 // Serve the original image back to the caller
 func (h *ImageHandler) ServeOriginal(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
@@ -66,20 +48,19 @@ func (h *ImageHandler) serveImage(w http.ResponseWriter, r *http.Request, req mo
 	// validate that the request URL was actually valid
 	err := utils.ValidateImageRequest(req)
 	if err != nil {
-		writeJSONError(w, http.StatusBadRequest, err.Error())
+		writeValidationError(w, r, err)
 		return
 	}
 
 	// here we conditionally check the metadata such as etag, last modified
-	metadata, err := h.imageService.GetImageMetadata(req)
+	metadata, err := h.imageService.GetImageMetadata(r.Context(), req)
 	if err != nil {
 		if err == services.ErrImageNotFound {
 			log.Printf("image not found: %s/%s", req.Wiki, req.Filename)
-			writePlaceholderResponse(w)
+			writeNotFound(w, r)
 			return
 		}
-		log.Printf("failed to retrieve image metadata: %v", err)
-		writeJSONError(w, http.StatusInternalServerError, "An erorr occurred, please try again later.")
+		writeInternalError(w, r, codeInternal, fmt.Errorf("failed to retrieve image metadata: %w", err))
 		return
 	}
 
@@ -87,21 +68,31 @@ func (h *ImageHandler) serveImage(w http.ResponseWriter, r *http.Request, req mo
 		return
 	}
 
+	// a HEAD can be answered entirely from the metadata, so don't download the body
+	if r.Method == http.MethodHead {
+		writeS3ObjectResponse(w, r, metadata)
+		return
+	}
+
+	br, ok := requestedRange(w, r, metadata)
+	if !ok {
+		return
+	}
+
 	// if we got here, we need to get the image from S3 and return it (either
 	// expired or we fucked up!)
-	obj, err := h.imageService.GetOriginalImage(req)
+	obj, err := h.imageService.GetOriginalImage(r.Context(), req, br)
 	if err != nil {
 		if err == services.ErrImageNotFound {
 			log.Printf("image not found: %s/%s", req.Wiki, req.Filename)
-			writePlaceholderResponse(w)
+			writeNotFound(w, r)
 			return
 		}
-		log.Printf("failed to retrieve image: %v", err)
-		writeJSONError(w, http.StatusInternalServerError, "An erorr occurred, please try again later.")
+		writeInternalError(w, r, codeInternal, fmt.Errorf("failed to retrieve image: %w", err))
 		return
 	}
 
-	writeS3ObjectResponse(w, obj)
+	writeS3ObjectResponse(w, r, obj)
 }
 
 // Serve the original thumbnail back to the caller, generating it if it doesn't exist
@@ -122,17 +113,39 @@ func (h *ImageHandler) ServeThumbnail(w http.ResponseWriter, r *http.Request) {
 		// this is a pass through format, we need to return the original,
 		// since we cannot thumbnail it
 		// @TODO: maybe instead we move this to the thumb generation bit?
-		model := models.ImageRequest{
-			Wiki:     req.Wiki,
-			Hash1:    req.Hash1,
-			Hash2:    req.Hash2,
-			Filename: req.Filename,
-			Revision: req.Revision,
-		}
-		h.serveImage(w, r, model)
+		h.serveImage(w, r, req.ImageRequest())
 		return
 	}
 
+	// turn the width (which may carry a density suffix) into the real pixel width
+	width, err := resolveWidth(w, r, req.Width, h.imageService.ClientHintsEnabled())
+	if err != nil {
+		writeValidationError(w, r, err)
+		return
+	}
+	req.Width = width
+
+	// a page of a multi-page file, ie ?page=2; other files only have the one
+	if ext == "tif" || ext == "tiff" {
+		if value := r.URL.Query().Get("page"); value != "" {
+			page, err := strconv.Atoi(value)
+			if err != nil || page < 1 || page > services.MaxTIFFPages {
+				writeProblem(w, r, http.StatusBadRequest, codeInvalidParameter, fmt.Sprintf("page must be a whole number from 1 to %d.", services.MaxTIFFPages))
+				return
+			}
+			req.Page = page
+		}
+	}
+
+	// serve a more modern format if the wiki allows it and the client supports it; the
+	// response then depends on the Accept header, so caches need to know to key on it
+	formats := h.imageService.ThumbnailFormats(req.Wiki)
+	transcodeGIF := ext == "gif" && h.imageService.TranscodeGIF(req.Wiki)
+	if len(formats) > 0 || transcodeGIF {
+		addVary(w.Header(), "Accept")
+		req.Format = negotiateFormat(r.Header.Get("Accept"), formats, ext, transcodeGIF)
+	}
+
 	// we can thumbnail this type of file, so generate the thumbnail
 	h.serveThumbnail(w, r, req)
 }
@@ -144,95 +157,240 @@ func (h *ImageHandler) serveThumbnail(w http.ResponseWriter, r *http.Request, re
 	err := utils.ValidateThumbnailRequest(req)
 
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeValidationError(w, r, err)
 		return
 	}
 
-	metadata, err := h.imageService.GetThumbnailMetadata(req)
+	metadata, err := h.imageService.GetThumbnailMetadata(r.Context(), req)
 	if err != nil {
-		if errors.Is(err, services.ErrImageNotFound) {
-			// no thumbnail exists
-			// fetch the original image to generate the thumbnail
-			model := models.ImageRequest{
-				Wiki:     req.Wiki,
-				Hash1:    req.Hash1,
-				Hash2:    req.Hash2,
-				Filename: req.Filename,
-				Revision: req.Revision,
-			}
+		// a wiki over its quota doesn't get any new sizes, but regenerating a stale thumbnail is fine
+		// since it replaces one that is already counted
+		if errors.Is(err, services.ErrImageNotFound) && h.imageService.OverQuota(req.Wiki) {
+			h.serveNearest(w, r, req)
+			return
+		}
+		if errors.Is(err, services.ErrImageNotFound) || errors.Is(err, services.ErrThumbnailStale) {
+			// no thumbnail exists, or it was made from an older version of the original, so generate one
+			h.generateThumbnail(w, r, req)
+			return
+		}
+		writeInternalError(w, r, codeInternal, fmt.Errorf("failed to retrieve thumbnail metadata: %w", err))
+		return
+	}
 
-			obj, err := h.imageService.GetOriginalImage(model)
-			if err != nil {
-				if err == services.ErrImageNotFound {
-					log.Printf("image not found: %s/%s", req.Wiki, req.Filename)
-					writePlaceholderResponse(w)
-					return
-				}
-				log.Printf("Failed to retrieve original image during thumbnail process: %v", err)
-				writeJSONError(w, http.StatusInternalServerError, "An erorr occurred, please try again later.")
-				return
-			}
+	h.serveStoredThumbnail(w, r, req, metadata)
+}
 
-			// here we pass the original image to the thumbnail generator, and the requested model
-			// this function saves the thumbnail to the temp dir and returns the path. It is this functions
-			// responsibility to upload the thumbnail to S3
-			path, err := h.imageService.ThumbnailImage(req, obj)
+// Return a thumbnail that is already in storage, or a 304 or just its headers if that is all
+// the caller needs
+func (h *ImageHandler) serveStoredThumbnail(w http.ResponseWriter, r *http.Request, req models.ThumbnailRequest, metadata *models.ImageResponse) {
+	if checkConditionalGet(w, r, metadata) {
+		return
+	}
 
-			if err != nil {
-				log.Printf("Failed to generate thumbnail: %v", err)
-				writeJSONError(w, http.StatusInternalServerError, "An erorr occurred generating the thumbnail, please try again later.")
-				return
-			}
+	if r.Method == http.MethodHead {
+		writeS3ObjectResponse(w, r, metadata)
+		return
+	}
 
-			// delete temp file when this func finishes
-			// @TODO: this is a rough draft - we need to handle this better and split out a lot of
-			// this into utility functions, but also remove a lot of the duplicated code
-			defer os.Remove(path)
+	br, ok := requestedRange(w, r, metadata)
+	if !ok {
+		return
+	}
 
-			// Upload the thumbnail to S3
-			err = h.imageService.UploadThumbnail(req, path)
-			if err != nil {
-				log.Printf("Failed to upload thumbnail to S3: %v", err)
-				writeJSONError(w, http.StatusInternalServerError, "An erorr occurred, please try again later.")
-				return
-			}
+	// not a 304, but the thumbnail exists so, lets return it!
+	obj, err := h.imageService.GetThumbnail(r.Context(), req, br)
 
-			// serve the thumbnail we just created
-			thumbObj, err := h.imageService.GetThumbnail(req)
-			if err != nil {
-				log.Printf("Failed to retrieve thumbnail after upload: %v", err)
-				writeJSONError(w, http.StatusInternalServerError, "An erorr occurred, please try again later.")
-				return
-			}
+	if err != nil {
+		if err == services.ErrImageNotFound {
+			log.Printf("thumbnail should exist but was not found: %s/%s", req.Wiki, req.Filename)
+			writeNotFound(w, r)
+			return
+		}
+		writeInternalError(w, r, codeInternal, fmt.Errorf("failed to retrieve thumbnail: %w", err))
+		return
+	}
+
+	writeS3ObjectResponse(w, r, obj)
 
-			// Set headers and return the thumbnail
-			writeS3ObjectResponse(w, thumbObj)
+}
+
+// Generate a thumbnail that doesn't exist yet from the original and return it to the caller
+// straight from memory, uploading it to S3 in the background for next time
+func (h *ImageHandler) generateThumbnail(w http.ResponseWriter, r *http.Request, req models.ThumbnailRequest) {
+	// fetch the original image to generate the thumbnail
+	model := req.ImageRequest()
+
+	// don't generate a thumbnail just to answer a HEAD, it will be generated
+	// on the first GET as long as the original exists
+	if r.Method == http.MethodHead {
+		h.headMissingThumbnail(w, r, req, model)
+		return
+	}
+
+	// if we already know the original is too small, don't fetch it again
+	policy := h.imageService.OversizePolicy(req.Wiki)
+	if tooLarge, known := h.imageService.CheckOversize(r.Context(), req); known && tooLarge != nil {
+		if policy != config.OversizeUpscale {
+			h.serveOversize(w, r, req, policy, tooLarge)
+			return
+		}
+		if tooLarge.Requested > h.imageService.MaxUpscaleWidth(req.Wiki) {
+			h.rejectUpscale(w, r, req)
 			return
 		}
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+
+	// we get the encoded thumbnail back in memory, so we can return it straight away
+	thumb, err := h.imageService.GenerateThumbnail(r.Context(), req)
+	if err == services.ErrImageNotFound {
+		log.Printf("image not found: %s/%s", req.Wiki, req.Filename)
+		writeNotFound(w, r)
+		return
+	}
+	if err == services.ErrPageNotFound {
+		writeProblem(w, r, http.StatusNotFound, codeNotFound, fmt.Sprintf("The file does not have a page %d.", req.Page))
 		return
 	}
 
-	if checkConditionalGet(w, r, metadata) {
+	if errors.Is(err, services.ErrUpscaleTooLarge) {
+		h.rejectUpscale(w, r, req)
 		return
 	}
 
-	// not a 304, but the thumbnail exists so, lets return it!
-	obj, err := h.imageService.GetThumbnail(req)
+	var tooLarge *services.WidthTooLargeError
+	if errors.As(err, &tooLarge) {
+		h.serveOversize(w, r, req, policy, tooLarge)
+		return
+	}
 
 	if err != nil {
-		if err == services.ErrImageNotFound {
-			log.Printf("thumbnail should exist but was not found: %s/%s", req.Wiki, req.Filename)
-			writePlaceholderResponse(w)
+		writeInternalError(w, r, codeThumbnailFailed, fmt.Errorf("failed to generate thumbnail: %w", err))
+		return
+	}
+
+	// store it in S3 for next time; this doesn't hold up the response, and if it
+	// fails the thumbnail will simply be generated again on the next request
+	h.imageService.UploadThumbnailAsync(r.Context(), req, thumb)
+
+	br, ok := requestedRange(w, r, thumb.Response(nil))
+	if !ok {
+		return
+	}
+
+	writeS3ObjectResponse(w, r, thumb.Response(br))
+}
+
+// Respond to a thumbnail request wider than the original, according to the wiki's oversize policy
+func (h *ImageHandler) serveOversize(w http.ResponseWriter, r *http.Request, req models.ThumbnailRequest, policy string, tooLarge *services.WidthTooLargeError) {
+	switch {
+	case policy == config.OversizeReject:
+		w.Header().Set("Cache-Control", "public, max-age=3600")
+		writeProblem(w, r, http.StatusBadRequest, codeWidthTooLarge, fmt.Sprintf(
+			"The requested width of %dpx is larger than the original image (%dpx), and this wiki does not upscale images.",
+			tooLarge.Requested, tooLarge.Original,
+		))
+	case req.Converted():
+		// browsers can't show the original of a converted thumbnail (ie a TIFF), so rather than
+		// returning it or redirecting to it, give them it at its own size in the thumbnail's format
+		req.Width = strconv.Itoa(tooLarge.Original)
+		h.serveThumbnail(w, r, req)
+	case policy == config.OversizeRedirect:
+		// the original could be replaced with a larger one, so don't let this be cached for too long
+		w.Header().Set("Cache-Control", "public, max-age=3600")
+		http.Redirect(w, r, originalURL(r), http.StatusFound)
+	default:
+		h.serveImage(w, r, req.ImageRequest())
+	}
+}
+
+// Refuse to upscale a thumbnail past the wiki's max_upscale_width
+func (h *ImageHandler) rejectUpscale(w http.ResponseWriter, r *http.Request, req models.ThumbnailRequest) {
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	writeProblem(w, r, http.StatusBadRequest, codeWidthTooLarge, fmt.Sprintf(
+		"The requested width of %spx is larger than the original image, and this wiki does not upscale images past %dpx.",
+		req.Width, h.imageService.MaxUpscaleWidth(req.Wiki),
+	))
+}
+
+// Respond to a request for a new thumbnail size from a wiki over its quota with the nearest size
+// that already exists, or the original if there are none (and browsers can show it). This is
+// served under the requested URL rather than redirected to, so that the page of a TIFF (in the
+// query string) goes along with it
+func (h *ImageHandler) serveNearest(w http.ResponseWriter, r *http.Request, req models.ThumbnailRequest) {
+	width, err := h.imageService.NearestThumbnail(r.Context(), req)
+	if err != nil && !errors.Is(err, services.ErrImageNotFound) {
+		writeInternalError(w, r, codeInternal, fmt.Errorf("failed to find the nearest thumbnail: %w", err))
+		return
+	}
+
+	// the quota could be raised or usage could go down, so don't let this be cached for too long
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+
+	if err == nil {
+		nearest := req
+		nearest.Width = width
+		metadata, err := h.imageService.GetThumbnailMetadata(r.Context(), nearest)
+		if err == nil {
+			h.serveStoredThumbnail(w, r, nearest, metadata)
 			return
 		}
-		log.Printf("failed to retrieve thumbnail: %v", err)
-		writeJSONError(w, http.StatusInternalServerError, "An erorr occurred, please try again later.")
+		// it could have been purged since it was listed, or be out of date
+		if !errors.Is(err, services.ErrImageNotFound) && !errors.Is(err, services.ErrThumbnailStale) {
+			writeInternalError(w, r, codeInternal, fmt.Errorf("failed to retrieve thumbnail metadata: %w", err))
+			return
+		}
+	}
+
+	// browsers can't show the original of a converted thumbnail (ie a TIFF), and making it in a
+	// format they can show would be a new size
+	if req.Converted() {
+		if _, err := h.imageService.GetImageMetadata(r.Context(), req.ImageRequest()); err != nil {
+			if errors.Is(err, services.ErrImageNotFound) {
+				writeNotFound(w, r)
+				return
+			}
+			writeInternalError(w, r, codeInternal, fmt.Errorf("failed to retrieve image metadata: %w", err))
+			return
+		}
+		writeProblem(w, r, http.StatusInsufficientStorage, codeQuotaExceeded,
+			"This wiki is over its thumbnail quota, and the file has no thumbnails that could be served instead.")
 		return
 	}
+	h.serveImage(w, r, req.ImageRequest())
+}
 
-	writeS3ObjectResponse(w, obj)
+// Get the URL of the original image route for a thumbnail request, by dropping the
+// scale-to-width part of the path. Anything before the wiki (ie a prefix added by a proxy) is
+// kept, and so is the query string, which can say which page of the file is wanted
+func originalURL(r *http.Request) string {
+	path := r.URL.EscapedPath()
+	if i := strings.LastIndex(path, "/scale-to-width/"); i != -1 {
+		path = path[:i]
+	}
+	if r.URL.RawQuery != "" {
+		path += "?" + r.URL.RawQuery
+	}
+	return path
+}
 
+// Answer a HEAD for a thumbnail that hasn't been generated yet. We only check that the
+// original exists; the length of the thumbnail isn't known until it has been generated
+// so we don't send one, and we ask caches not to hold on to the response
+func (h *ImageHandler) headMissingThumbnail(w http.ResponseWriter, r *http.Request, req models.ThumbnailRequest, original models.ImageRequest) {
+	_, err := h.imageService.GetImageMetadata(r.Context(), original)
+	if err != nil {
+		if err == services.ErrImageNotFound {
+			writeNotFound(w, r)
+			return
+		}
+		writeInternalError(w, r, codeInternal, fmt.Errorf("failed to retrieve image metadata: %w", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", h.imageService.ThumbnailContentType(req))
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
 }
 
 // Check whether we can send a 304 not modified response to the caller
@@ -250,7 +408,9 @@ func checkConditionalGet(w http.ResponseWriter, r *http.Request, metadata *model
 			if !metadata.LastModified.IsZero() {
 				w.Header().Set("Last-Modified", metadata.LastModified.UTC().Format(http.TimeFormat))
 			}
-			w.Header().Set("Cache-Control", "public, max-age=31536000")
+			if w.Header().Get("Cache-Control") == "" {
+				w.Header().Set("Cache-Control", "public, max-age=31536000")
+			}
 			w.WriteHeader(http.StatusNotModified)
 			return true
 		}
@@ -263,7 +423,9 @@ func checkConditionalGet(w http.ResponseWriter, r *http.Request, metadata *model
 					w.Header().Set("ETag", metadata.ETag)
 				}
 				w.Header().Set("Last-Modified", metadata.LastModified.UTC().Format(http.TimeFormat))
-				w.Header().Set("Cache-Control", "public, max-age=31536000")
+				if w.Header().Get("Cache-Control") == "" {
+					w.Header().Set("Cache-Control", "public, max-age=31536000")
+				}
 				w.WriteHeader(http.StatusNotModified)
 				return true
 			}
@@ -273,15 +435,29 @@ func checkConditionalGet(w http.ResponseWriter, r *http.Request, metadata *model
 	return false
 }
 
-// Utility function to write common headers for S3 object responses
-func writeS3ObjectResponse(w http.ResponseWriter, obj *models.ImageResponse) {
+// Utility function to write common headers for S3 object responses, the body is
+// only written for GET requests. It is streamed to the client in small chunks and closed
+// once we are done with it. If the object only covers part of the file (because a range was
+// requested from S3) a 206 is sent instead
+func writeS3ObjectResponse(w http.ResponseWriter, r *http.Request, obj *models.ImageResponse) {
 	if obj == nil {
 		return
 	}
+	if obj.Body != nil {
+		defer obj.Body.Close()
+	}
+
 	// set headers
 	w.Header().Set("Content-Type", obj.ContentType)
-	w.Header().Set("Content-Length", strconv.FormatInt(obj.Length, 10))
-	w.Header().Set("Cache-Control", "public, max-age=31536000")
+	// unknown for some files fetched from the origin
+	if obj.Length >= 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(obj.Length, 10))
+	}
+	// unless the caller has already said how long this may be cached for
+	if w.Header().Get("Cache-Control") == "" {
+		w.Header().Set("Cache-Control", "public, max-age=31536000")
+	}
+	w.Header().Set("Accept-Ranges", "bytes")
 
 	if obj.ETag != "" {
 		w.Header().Set("ETag", obj.ETag)
@@ -293,16 +469,21 @@ func writeS3ObjectResponse(w http.ResponseWriter, obj *models.ImageResponse) {
 		w.Header().Set("Last-Modified", obj.LastModified.UTC().Format(http.TimeFormat))
 	}
 
-	_, _ = w.Write(obj.Data)
-}
+	if r.Method == http.MethodHead || obj.Body == nil {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
 
-// Utility function to write JSON error responses
-func writeJSONError(w http.ResponseWriter, status int, message string) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(status)
+	if obj.ContentRange != "" {
+		w.Header().Set("Content-Range", obj.ContentRange)
+		w.WriteHeader(http.StatusPartialContent)
+	}
 
-	resp := map[string]string{
-		"error": message,
+	// io.Copy works through a fixed size buffer (net/http uses a pooled one), so
+	// however large the object is only a few KB of it is in memory at a time
+	if _, err := io.Copy(w, obj.Body); err != nil {
+		// headers have already gone, so all we can do is log it and let the
+		// client notice that the body is short
+		log.Printf("failed to stream object to client: %v", err)
 	}
-	_ = json.NewEncoder(w).Encode(resp)
 }
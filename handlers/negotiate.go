@@ -0,0 +1,50 @@
+package handlers
+
+import (
+	"mime"
+	"strconv"
+	"strings"
+)
+
+// Check whether the Accept header explicitly lists the media type with a non-zero quality.
+// Wildcards (image/* and */*) are deliberately not honoured; browsers that don't support a
+// modern format still send them, so only an explicit mention tells us the format is safe to send
+func acceptsType(accept, mediaType string) bool {
+	for _, part := range strings.Split(accept, ",") {
+		mt, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil || mt != mediaType {
+			continue
+		}
+
+		if q, ok := params["q"]; ok {
+			quality, err := strconv.ParseFloat(q, 64)
+			if err != nil || quality <= 0 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// Pick the first of the wiki's configured formats that the client accepts, returning an
+// empty string if the thumbnail should be served in the source's own format
+func negotiateFormat(accept string, formats []string, sourceFormat string, transcodeGIF bool) string {
+	// a GIF would lose its animation as anything but an animated WebP, which is opt in
+	if sourceFormat == "gif" {
+		if transcodeGIF && acceptsType(accept, "image/webp") {
+			return "webp"
+		}
+		return ""
+	}
+
+	for _, format := range formats {
+		if format == sourceFormat {
+			return ""
+		}
+		if acceptsType(accept, "image/"+format) {
+			return format
+		}
+	}
+	return ""
+}
@@ -0,0 +1,116 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/telepedia/thumbra/models"
+)
+
+var errRangeNotSatisfiable = errors.New("requested range not satisfiable")
+
+// Parse the Range header against an object of the given size. We only support a single
+// range - anything else (multiple ranges, other units, or garbage) returns nil so that the
+// caller serves the whole object, which RFC 9110 explicitly allows. A syntactically valid
+// range that lies entirely outside the object returns errRangeNotSatisfiable
+func parseRange(header string, size int64) (*models.ByteRange, error) {
+	if header == "" || size <= 0 {
+		return nil, nil
+	}
+
+	spec, ok := strings.CutPrefix(header, "bytes=")
+	if !ok || strings.Contains(spec, ",") {
+		return nil, nil
+	}
+
+	startStr, endStr, ok := strings.Cut(strings.TrimSpace(spec), "-")
+	if !ok {
+		return nil, nil
+	}
+
+	// suffix range, ie bytes=-500 is the last 500 bytes of the object
+	if startStr == "" {
+		n, err := strconv.ParseInt(endStr, 10, 64)
+		if err != nil || n < 0 {
+			return nil, nil
+		}
+		if n == 0 {
+			return nil, errRangeNotSatisfiable
+		}
+		if n > size {
+			n = size
+		}
+		return &models.ByteRange{Start: size - n, Length: n}, nil
+	}
+
+	start, err := strconv.ParseInt(startStr, 10, 64)
+	if err != nil || start < 0 {
+		return nil, nil
+	}
+	if start >= size {
+		return nil, errRangeNotSatisfiable
+	}
+
+	end := size - 1
+	if endStr != "" {
+		end, err = strconv.ParseInt(endStr, 10, 64)
+		if err != nil || end < start {
+			return nil, nil
+		}
+		if end >= size {
+			end = size - 1
+		}
+	}
+
+	return &models.ByteRange{Start: start, Length: end - start + 1}, nil
+}
+
+// Check whether the If-Range precondition (if any) allows a partial response. If the
+// validator doesn't match the current representation the Range header must be ignored
+// and the full object returned instead
+func checkIfRange(r *http.Request, metadata *models.ImageResponse) bool {
+	ifRange := r.Header.Get("If-Range")
+	if ifRange == "" {
+		return true
+	}
+
+	// entity tags must use the strong comparison, so weak tags never match
+	if strings.HasPrefix(ifRange, `"`) || strings.HasPrefix(ifRange, "W/") {
+		return !strings.HasPrefix(ifRange, "W/") && ifRange == metadata.ETag
+	}
+
+	t, err := http.ParseTime(ifRange)
+	if err != nil || metadata.LastModified.IsZero() {
+		return false
+	}
+
+	return metadata.LastModified.UTC().Truncate(time.Second).Equal(t.UTC())
+}
+
+// Work out which part of the object the client asked for from the metadata we already
+// have, so that only that part is requested from S3. Returns nil for the whole object,
+// and false if a 416 has been written because the range can't be satisfied
+func requestedRange(w http.ResponseWriter, r *http.Request, metadata *models.ImageResponse) (*models.ByteRange, bool) {
+	if r.Method != http.MethodGet || metadata == nil || !checkIfRange(r, metadata) {
+		return nil, true
+	}
+
+	br, err := parseRange(r.Header.Get("Range"), metadata.Length)
+	if err != nil {
+		writeRangeNotSatisfiable(w, r, metadata.Length)
+		return nil, false
+	}
+
+	return br, true
+}
+
+// Write a 416 response indicating the size of the object so that the client can retry
+func writeRangeNotSatisfiable(w http.ResponseWriter, r *http.Request, size int64) {
+	w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+	writeProblem(w, r, http.StatusRequestedRangeNotSatisfiable, codeRangeNotSatisfiable,
+		fmt.Sprintf("The requested range is outside of the file, which is %d bytes long.", size))
+}
@@ -1,19 +1,43 @@
 package handlers
 
 import (
+	"net/http"
+
 	"github.com/gorilla/mux"
 	"github.com/telepedia/thumbra/middleware"
-	"github.com/telepedia/thumbra/storage"
+	"github.com/telepedia/thumbra/services"
 )
 
-func SetupRoutes(r *mux.Router, s3Client *storage.S3Client) {
-	imageHandler := NewImageHandler(s3Client)
+func SetupRoutes(r *mux.Router, imageService *services.ImageService, readiness *Readiness) {
+	imageHandler := NewImageHandler(imageService)
 
 	r.Use(middleware.ImageResponseMiddleware)
 
+	// the middleware isn't run for requests that don't match a route, so wrap these ourselves
+	r.NotFoundHandler = middleware.ImageResponseMiddleware(http.HandlerFunc(serveRouteNotFound))
+	r.MethodNotAllowedHandler = middleware.ImageResponseMiddleware(http.HandlerFunc(serveMethodNotAllowed))
+
+	// for the load balancer; this can't clash with the image routes, which are much longer
+	r.HandleFunc("/-/ready", readiness.ServeReady).Methods(http.MethodGet, http.MethodHead)
+
+	// the admin API only exists once a token has been set for it
+	if imageService.AdminToken() != "" {
+		adminHandler := NewAdminHandler(imageService)
+		r.HandleFunc("/-/admin/purge/{wiki}/{hash1}/{hash2}/{filename}", adminHandler.ServePurge)
+		r.HandleFunc("/-/admin/sweep/{wiki}", adminHandler.ServeSweep)
+		r.HandleFunc("/-/admin/usage", adminHandler.ServeUsage)
+	}
+
+	r.HandleFunc("/{wiki}/{hash1}/{hash2}/{filename}/revision/{revision}",
+		imageHandler.ServeOriginal).Methods(http.MethodGet, http.MethodHead)
+
+	r.HandleFunc("/{wiki}/{hash1}/{hash2}/{filename}/revision/{revision}/scale-to-width/{width}",
+		imageHandler.ServeThumbnail).Methods(http.MethodGet, http.MethodHead)
+
+	// CORS preflights for every image route
 	r.HandleFunc("/{wiki}/{hash1}/{hash2}/{filename}/revision/{revision}",
-		imageHandler.ServeOriginal).Methods("GET")
+		middleware.ServePreflight).Methods(http.MethodOptions)
 
 	r.HandleFunc("/{wiki}/{hash1}/{hash2}/{filename}/revision/{revision}/scale-to-width/{width}",
-		imageHandler.ServeThumbnail).Methods("GET")
+		middleware.ServePreflight).Methods(http.MethodOptions)
 }
@@ -1,32 +1,104 @@
 package main
 
 import (
+	"context"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/telepedia/thumbra/config"
 	"github.com/telepedia/thumbra/handlers"
+	"github.com/telepedia/thumbra/middleware"
+	"github.com/telepedia/thumbra/server"
+	"github.com/telepedia/thumbra/services"
 	"github.com/telepedia/thumbra/storage"
 )
 
 func main() {
 	cfg := config.Load()
-	s3Client := storage.New(cfg.S3)
+	originals, thumbnails, err := storage.NewBackends(cfg)
+	if err != nil {
+		log.Fatalf("Failed to set up storage: %v", err)
+	}
+	// thumbra reconcile <prefix>... compares the primary and replica backends, and exits
+	if len(os.Args) > 1 && os.Args[1] == "reconcile" {
+		os.Exit(reconcile(originals, thumbnails, os.Args[2:]))
+	}
+
+	imageService := services.NewImageService(originals, thumbnails, storage.NewOrigin(cfg.Origin), cfg)
+	readiness := handlers.NewReadiness()
+	inFlight := &middleware.InFlight{}
 
 	r := mux.NewRouter()
-	handlers.SetupRoutes(r, s3Client)
+	handlers.SetupRoutes(r, imageService, readiness)
+
+	srv, err := server.New(cfg.Server, inFlight.Middleware(r))
+	if err != nil {
+		log.Fatalf("Failed to configure server: %v", err)
+	}
+
+	listeners, err := server.Listen(cfg.Server)
+	if err != nil {
+		log.Fatalf("Failed to listen: %v", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+
+	for _, l := range listeners {
+		go func() {
+			log.Printf("Server listening on %s://%s (tls: %t)", l.Addr().Network(), l.Addr(), l.TLS)
+			if err := server.Serve(srv, l); err != nil {
+				log.Fatalf("Server failed: %v", err)
+			}
+		}()
+	}
 
-	srv := &http.Server{
-		Handler:      r,
-		Addr:         ":" + cfg.Server.Port,
-		WriteTimeout: time.Duration(cfg.Server.WriteTimeout) * time.Second,
-		ReadTimeout:  time.Duration(cfg.Server.ReadTimeout) * time.Second,
+	// these stop along with everything else when we are told to shut down
+	if cfg.Sweeper.Enabled {
+		go imageService.RunSweeper(ctx)
 	}
+	if cfg.Usage.ScanInterval > 0 {
+		go imageService.RunUsageScanner(ctx)
+	}
+
+	<-ctx.Done()
+	// a second signal kills us straight away
+	stop()
+
+	shutdown(srv, cfg.Server, readiness, inFlight, imageService)
+}
+
+// Shut down without cutting anyone off: tell the load balancer we're going away, give it time to
+// notice, then stop accepting connections and let in-flight requests and thumbnail uploads finish
+// within the grace period. Anything still going after that is abandoned and logged
+func shutdown(srv *http.Server, cfg config.ServerConfig, readiness *handlers.Readiness, inFlight *middleware.InFlight, imageService *services.ImageService) {
+	drainDelay := time.Duration(cfg.DrainDelay) * time.Second
+	grace := time.Duration(cfg.ShutdownGrace) * time.Second
 
-	log.Printf("Server listening on %s", srv.Addr)
-	if err := srv.ListenAndServe(); err != nil {
-		log.Fatalf("Server failed: %v", err)
+	log.Printf("Shutting down, draining for %s", drainDelay)
+	readiness.Drain()
+	time.Sleep(drainDelay)
+
+	ctx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+
+	log.Printf("No longer accepting connections, waiting up to %s for %d in-flight requests", grace, inFlight.Count())
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("Abandoning %d in-flight requests: %v", inFlight.Count(), err)
+		_ = srv.Close()
 	}
+
+	if pending := imageService.WaitForUploads(ctx); len(pending) > 0 {
+		log.Printf("Abandoning %d thumbnail uploads:", len(pending))
+		for _, key := range pending {
+			log.Printf("  %s", key)
+		}
+	}
+
+	log.Println("Shutdown complete")
 }
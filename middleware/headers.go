@@ -8,7 +8,20 @@ func ImageResponseMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("X-Backend", "Thumbra")
 		w.Header().Set("Access-Control-Allow-Origin", "*")
+		// allow scripts doing range requests to see how much they got back
+		w.Header().Set("Access-Control-Expose-Headers", "Accept-Ranges, Content-Length, Content-Range, ETag, Last-Modified")
 
 		next.ServeHTTP(w, r)
 	})
 }
+
+// Answer a CORS preflight for the image routes. The allowed origin is set by
+// ImageResponseMiddleware, so here we only need to describe what the actual request may do
+func ServePreflight(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Range, If-Range, If-None-Match, If-Modified-Since")
+	// browsers cap this anyway, but there is no reason to preflight more than once a day
+	w.Header().Set("Access-Control-Max-Age", "86400")
+	w.Header().Set("Allow", "GET, HEAD, OPTIONS")
+	w.WriteHeader(http.StatusNoContent)
+}
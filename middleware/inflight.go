@@ -0,0 +1,26 @@
+package middleware
+
+import (
+	"net/http"
+	"sync/atomic"
+)
+
+// Counts the requests that are currently being handled, so that on shutdown we
+// can report how many we had to abandon
+type InFlight struct {
+	count atomic.Int64
+}
+
+func (f *InFlight) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.count.Add(1)
+		defer f.count.Add(-1)
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// How many requests are being handled right now
+func (f *InFlight) Count() int64 {
+	return f.count.Load()
+}
@@ -2,6 +2,7 @@ package models
 
 import (
 	"fmt"
+	"io"
 	"time"
 )
 
@@ -17,13 +18,38 @@ type ImageRequest struct {
 // length, content type etc (we pull this from S3 to avoid calculating
 // ourselves and wasting processing time since the response will
 // already contain it)
+// Body is nil for metadata-only (HEAD) responses; otherwise it streams the object
+// straight from S3 and whoever ends up with the response must close it
 type ImageResponse struct {
-	Data               []byte
+	Body               io.ReadCloser
 	ContentType        string
 	Length             int64
 	ETag               string
 	LastModified       time.Time
 	ContentDisposition string
+	// set when only part of the object was requested, in which case Length
+	// is the length of the part, not the whole object
+	ContentRange string
+	// user metadata stored with the object, with lower case keys; nil if
+	// there isn't any or the backend can't store it
+	Metadata map[string]string
+}
+
+// A single byte range of an object; Start is inclusive and Length is the
+// number of bytes from Start
+type ByteRange struct {
+	Start  int64
+	Length int64
+}
+
+// The value to send in a Range header when requesting this range from S3
+func (br *ByteRange) Header() string {
+	return fmt.Sprintf("bytes=%d-%d", br.Start, br.Start+br.Length-1)
+}
+
+// The value of the Content-Range header for this range of an object of the given size
+func (br *ByteRange) ContentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", br.Start, br.Start+br.Length-1, size)
 }
 
 // Helper to convert the URL parameters to the file path (albeit virtual)
@@ -41,3 +67,16 @@ func (ir *ImageRequest) GetArchiveKey() string {
 	filename := ir.Revision + "!" + ir.Filename
 	return fmt.Sprintf("%s/archive/%s/%s/%s", ir.Wiki, ir.Hash1, ir.Hash2, filename)
 }
+
+// The prefix that every thumbnail of the latest version of the file is under
+// i.e. /{wiki}/thumb/{hash1}/{hash2}/{filename}/
+func (ir *ImageRequest) GetThumbPrefix() string {
+	return fmt.Sprintf("%s/thumb/%s/%s/%s/", ir.Wiki, ir.Hash1, ir.Hash2, ir.Filename)
+}
+
+// The prefix that every thumbnail of an archived revision of the file is under
+// i.e. /{wiki}/thumb/archive/{hash1}/{hash2}/20250818122033!{filename}/
+func (ir *ImageRequest) GetThumbArchivePrefix() string {
+	filename := ir.Revision + "!" + ir.Filename
+	return fmt.Sprintf("%s/thumb/archive/%s/%s/%s/", ir.Wiki, ir.Hash1, ir.Hash2, filename)
+}
@@ -1,6 +1,14 @@
 package models
 
-import "fmt"
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
 
 type ThumbnailRequest struct {
 	Wiki     string
@@ -9,19 +17,108 @@ type ThumbnailRequest struct {
 	Filename string
 	Revision string
 	Width    string
+	// the format negotiated with the client, if it isn't the source's own
+	// format; such variants are stored next to the canonical thumbnail
+	Format string
+	// the page of a multi-page file (a TIFF) to thumbnail, from 1; 0 is the first page too
+	Page int
+}
+
+// Formats browsers can't show, and the format their thumbnails are made in instead; these are
+// the same as MediaWiki's, so the thumbnails end up under the same keys
+var convertedFormats = map[string]string{
+	"tif":  "jpg",
+	"tiff": "jpg",
+	"bmp":  "png",
+}
+
+// The request for the original image that this thumbnail is generated from
+func (ir *ThumbnailRequest) ImageRequest() ImageRequest {
+	return ImageRequest{
+		Wiki:     ir.Wiki,
+		Hash1:    ir.Hash1,
+		Hash2:    ir.Hash2,
+		Filename: ir.Filename,
+		Revision: ir.Revision,
+	}
+}
+
+// The format of the source image, from its extension
+func (ir *ThumbnailRequest) SourceFormat() string {
+	return strings.ToLower(strings.TrimPrefix(filepath.Ext(ir.Filename), "."))
+}
+
+// The format the thumbnail will be encoded in
+func (ir *ThumbnailRequest) OutputFormat() string {
+	if ir.Format != "" {
+		return ir.Format
+	}
+	if format, ok := convertedFormats[ir.SourceFormat()]; ok {
+		return format
+	}
+	return ir.SourceFormat()
+}
+
+// Whether the source is in a format browsers can't show, so its thumbnails are always converted
+func (ir *ThumbnailRequest) Converted() bool {
+	_, ok := convertedFormats[ir.SourceFormat()]
+	return ok
+}
+
+// The name of the thumbnail file, {width}px-{filename}, named the same way MediaWiki names
+// them: a thumbnail in a different format to the original (negotiated, or converted as the
+// original can't be shown) has that format's extension appended, and pages after the first
+// are prefixed with the page, ie 300px-Foo.png.webp and page2-300px-Foo.tif.jpg
+func (ir *ThumbnailRequest) thumbnailName() string {
+	name := ir.Width + "px-" + ir.Filename
+	if format := ir.OutputFormat(); format != ir.SourceFormat() {
+		name += "." + format
+	}
+	if ir.Page > 1 {
+		name = "page" + strconv.Itoa(ir.Page) + "-" + name
+	}
+	return name
 }
 
 // Get the s3 key for the latest thumbnail
 // will be in s3 in something like /{wiki}/thumb/{hash1}/{hash2}/{filename}/{width}px-{filename}
 func (ir *ThumbnailRequest) GetS3ThumbKey() string {
-	thumbnailName := ir.Width + "px-" + ir.Filename
-	return fmt.Sprintf("%s/thumb/%s/%s/%s/%s", ir.Wiki, ir.Hash1, ir.Hash2, ir.Filename, thumbnailName)
+	return fmt.Sprintf("%s/thumb/%s/%s/%s/%s", ir.Wiki, ir.Hash1, ir.Hash2, ir.Filename, ir.thumbnailName())
 }
 
 // Return the s3 key for an archived thumbnail
 // will be in s3 in something like /{wiki}/thumb/archive/{hash1}/{hash2}/20250818122033!{filename}/{width}px-{filename}
 func (ir *ThumbnailRequest) GetThumbArchiveKey() string {
 	filename := ir.Revision + "!" + ir.Filename
-	thumbnailName := ir.Width + "px-" + ir.Filename
-	return fmt.Sprintf("%s/thumb/archive/%s/%s/%s/%s", ir.Wiki, ir.Hash1, ir.Hash2, filename, thumbnailName)
+	return fmt.Sprintf("%s/thumb/archive/%s/%s/%s/%s", ir.Wiki, ir.Hash1, ir.Hash2, filename, ir.thumbnailName())
+}
+
+// A thumbnail that has just been generated and is held in memory, so that it can
+// be returned to the caller straight away while it is uploaded to S3 in the background
+type GeneratedThumbnail struct {
+	Data         []byte
+	ContentType  string
+	ETag         string
+	LastModified time.Time
+	// the ETag of the original it was made from
+	SourceETag string
+}
+
+// Build a response for the thumbnail, or the part of it covered by br if not nil
+func (gt *GeneratedThumbnail) Response(br *ByteRange) *ImageResponse {
+	resp := &ImageResponse{
+		Body:         io.NopCloser(bytes.NewReader(gt.Data)),
+		ContentType:  gt.ContentType,
+		Length:       int64(len(gt.Data)),
+		ETag:         gt.ETag,
+		LastModified: gt.LastModified,
+	}
+
+	if br != nil {
+		resp.Body = io.NopCloser(bytes.NewReader(gt.Data[br.Start : br.Start+br.Length]))
+		resp.Length = br.Length
+		resp.ContentRange = br.ContentRange(int64(len(gt.Data)))
+	}
+
+	return resp
 }
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/telepedia/thumbra/storage"
+)
+
+// Compare the primary and replica backends under each prefix (ie "metawiki/") and print
+// every object that is missing from one of them or differs between them. Returns the
+// exit code: 0 if they match, 1 if they don't
+func reconcile(originals, thumbnails storage.Backend, prefixes []string) int {
+	backends := []storage.Backend{originals}
+	if thumbnails != originals {
+		backends = append(backends, thumbnails)
+	}
+
+	if len(prefixes) == 0 {
+		log.Fatalln("Usage: thumbra reconcile <prefix>...")
+	}
+
+	consistent := true
+	for _, backend := range backends {
+		replicated, ok := backend.(*storage.Replicated)
+		if !ok {
+			log.Fatalln("There is no replica to reconcile, set [storage.replica]")
+		}
+
+		for _, prefix := range prefixes {
+			report, err := replicated.Reconcile(context.Background(), prefix)
+			if err != nil {
+				log.Fatalf("Failed to reconcile %s: %v", prefix, err)
+			}
+
+			for _, key := range report.PrimaryOnly {
+				fmt.Printf("primary-only\t%s\n", key)
+			}
+			for _, key := range report.SecondaryOnly {
+				fmt.Printf("secondary-only\t%s\n", key)
+			}
+			for _, key := range report.Different {
+				fmt.Printf("different\t%s\n", key)
+			}
+			log.Printf("Reconciled %s: %d objects, %d only in the primary, %d only in the secondary, %d different",
+				prefix, report.Checked, len(report.PrimaryOnly), len(report.SecondaryOnly), len(report.Different))
+
+			consistent = consistent && report.Consistent()
+		}
+	}
+
+	if !consistent {
+		return 1
+	}
+	return 0
+}
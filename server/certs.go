@@ -0,0 +1,106 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// how often the certificate and key are checked for changes
+const certCheckInterval = 30 * time.Second
+
+// Serves a TLS certificate from files on disk, reloading it when either file changes so that
+// renewed certificates are picked up without a restart. If a reload fails (ie we caught the
+// files half way through being replaced) the previous certificate is kept and we try again later
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	cr := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := cr.reload(); err != nil {
+		return nil, err
+	}
+
+	go cr.watch()
+
+	return cr, nil
+}
+
+func (cr *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
+	return cr.cert, nil
+}
+
+// Check the files for changes every certCheckInterval for as long as the process runs. We poll
+// rather than watch for events, since certificates are often replaced by swapping symlinks
+func (cr *certReloader) watch() {
+	ticker := time.NewTicker(certCheckInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		modTime, err := cr.latestModTime()
+		if err != nil {
+			log.Printf("failed to check TLS certificate for changes: %v", err)
+			continue
+		}
+
+		cr.mu.RLock()
+		// any change counts, a swapped in file can be older than the one it replaced
+		changed := !modTime.Equal(cr.modTime)
+		cr.mu.RUnlock()
+
+		if !changed {
+			continue
+		}
+
+		if err := cr.reload(); err != nil {
+			log.Printf("failed to reload TLS certificate, keeping the previous one: %v", err)
+			continue
+		}
+		log.Printf("Reloaded TLS certificate from %s", cr.certFile)
+	}
+}
+
+func (cr *certReloader) reload() error {
+	modTime, err := cr.latestModTime()
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	cr.cert = &cert
+	cr.modTime = modTime
+
+	return nil
+}
+
+// the most recent modification time of the certificate and key, following symlinks
+func (cr *certReloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, file := range []string{cr.certFile, cr.keyFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("failed to stat %s: %w", file, err)
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
@@ -0,0 +1,121 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/telepedia/thumbra/config"
+)
+
+// A listener along with how it should be served
+type Listener struct {
+	net.Listener
+	TLS bool
+}
+
+// Build the HTTP server from the [server] config. HTTP/1.1 is always served, HTTP/2 over
+// TLS when TLS is enabled, and cleartext HTTP/2 when h2c is enabled
+func New(cfg config.ServerConfig, handler http.Handler) (*http.Server, error) {
+	srv := &http.Server{
+		Handler:           handler,
+		WriteTimeout:      time.Duration(cfg.WriteTimeout) * time.Second,
+		ReadTimeout:       time.Duration(cfg.ReadTimeout) * time.Second,
+		IdleTimeout:       time.Duration(cfg.IdleTimeout) * time.Second,
+		ReadHeaderTimeout: time.Duration(cfg.ReadHeaderTimeout) * time.Second,
+	}
+
+	srv.Protocols = new(http.Protocols)
+	srv.Protocols.SetHTTP1(true)
+	srv.Protocols.SetHTTP2(true)
+	srv.Protocols.SetUnencryptedHTTP2(cfg.H2C)
+
+	if cfg.TLSEnabled() {
+		certs, err := newCertReloader(cfg.TLSCert, cfg.TLSKey)
+		if err != nil {
+			return nil, err
+		}
+		srv.TLSConfig = &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: certs.GetCertificate,
+		}
+	}
+
+	return srv, nil
+}
+
+// Open every listener the [server] config asks for: the TCP address (with TLS if enabled)
+// and the Unix domain socket. If any of them fails, those already opened are closed
+func Listen(cfg config.ServerConfig) ([]Listener, error) {
+	var listeners []Listener
+
+	if addr := cfg.ListenAddress(); addr != "" {
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to listen on %s: %w", addr, err)
+		}
+		listeners = append(listeners, Listener{Listener: l, TLS: cfg.TLSEnabled()})
+	}
+
+	if cfg.Socket != "" {
+		l, err := listenUnix(cfg.Socket, cfg.SocketMode)
+		if err != nil {
+			for _, opened := range listeners {
+				_ = opened.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, Listener{Listener: l})
+	}
+
+	return listeners, nil
+}
+
+// Serve requests on a listener until the server is shut down
+func Serve(srv *http.Server, l Listener) error {
+	var err error
+	if l.TLS {
+		// the certificate comes from TLSConfig.GetCertificate
+		err = srv.ServeTLS(l, "", "")
+	} else {
+		err = srv.Serve(l)
+	}
+
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// Listen on a Unix domain socket. A socket left behind by an instance that didn't shut down
+// cleanly is removed first; the socket is removed again when the listener is closed
+func listenUnix(path, mode string) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode().Type() != fs.ModeSocket {
+			return nil, fmt.Errorf("refusing to replace %s, which is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("failed to remove stale socket %s: %w", path, err)
+		}
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", path, err)
+	}
+
+	// already validated when the config was loaded
+	perm, _ := strconv.ParseUint(mode, 8, 32)
+	if err := os.Chmod(path, fs.FileMode(perm)); err != nil {
+		_ = l.Close()
+		return nil, fmt.Errorf("failed to set permissions on %s: %w", path, err)
+	}
+
+	return l, nil
+}
@@ -0,0 +1,509 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"sort"
+	"time"
+
+	"github.com/HugoSmits86/nativewebp"
+	"github.com/disintegration/imaging"
+)
+
+var (
+	errTruncatedGIF  = errors.New("gif: truncated")
+	errTruncatedWebP = errors.New("webp: truncated")
+	// returned by a render callback to stop after the frame it was given
+	errStopRender = errors.New("stop rendering")
+)
+
+// An animated GIF or WebP, decoded far enough to draw its frames one at a time
+type animation struct {
+	// how many times it plays; 0 for forever
+	plays int
+	// every colour a GIF was drawn with, which its thumbnail's frames are mapped back onto; nil for
+	// WebPs, and for GIFs with more colours than fit in one palette
+	palette color.Palette
+	// draw each frame onto a canvas the size of the whole animation in turn, calling fn with the
+	// canvas as it should be shown after each. The canvas is reused, so fn mustn't hold on to it
+	render func(ctx context.Context, fn func(frame animationFrame) error) error
+}
+
+type animationFrame struct {
+	image image.Image
+	delay time.Duration
+}
+
+// Make an animated thumbnail of an animated GIF or WebP, keeping the timing of its frames, its loop
+// count and transparency; GIFs can be made into animated WebPs as well as GIFs. animated is false if
+// there is only one frame, or more frames × pixels (of the source or the thumbnail, whichever is
+// larger) than max_animated_area (as MediaWiki's $wgMaxAnimatedGifArea), in which case a still
+// should be made instead. The frames are counted before anything is decoded, so one over the budget
+// doesn't cost any more than a still. Files that are broken part of the way through are made into
+// stills too, as their first frame often isn't
+func (is *ImageService) animatedThumbnail(ctx context.Context, data []byte, source, output string, width int) (thumb []byte, animated bool, err error) {
+	if output != "gif" && output != "webp" || source == "webp" && output != "webp" {
+		return nil, false, nil
+	}
+
+	frames := countFrames(data, source)
+	if frames <= 1 {
+		return nil, false, nil
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, false, nil
+	}
+	// upscaled thumbnails are bigger than the source, and it is the bigger of the two that costs
+	height := max(int64(cfg.Height)*int64(width)/int64(max(cfg.Width, 1)), 1)
+	pixels := max(int64(cfg.Width)*int64(cfg.Height), int64(width)*height)
+	if area := int64(frames) * pixels; area > int64(is.cfg.Thumbnails.MaxAnimatedArea) {
+		return nil, false, nil
+	}
+
+	anim, err := decodeAnimation(data, source)
+	if err != nil {
+		return nil, false, nil
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, false, err
+	}
+
+	resized, err := resizeAnimation(ctx, anim, width)
+	if err != nil {
+		return nil, false, err
+	}
+
+	var buf bytes.Buffer
+	if output == "gif" {
+		err = encodeAnimatedGIF(&buf, resized, anim.plays, anim.palette)
+	} else {
+		err = encodeAnimatedWebP(&buf, resized, anim.plays, source == "gif")
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to encode thumbnail: %w", err)
+	}
+	return buf.Bytes(), true, nil
+}
+
+// Count the frames of an animated GIF or WebP without decoding any of them; anything that isn't
+// animated, or can't be read, has 0 or 1
+func countFrames(data []byte, format string) int {
+	switch format {
+	case "gif":
+		frames, _ := countGIFFrames(data)
+		return frames
+	case "webp":
+		wa, err := parseWebP(data)
+		if err != nil || wa == nil {
+			return 0
+		}
+		return len(wa.frames)
+	default:
+		return 0
+	}
+}
+
+func decodeAnimation(data []byte, format string) (*animation, error) {
+	switch format {
+	case "gif":
+		g, err := gif.DecodeAll(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		return gifAnimation(g), nil
+	case "webp":
+		wa, err := parseWebP(data)
+		if err != nil {
+			return nil, err
+		}
+		if wa == nil {
+			return nil, fmt.Errorf("webp: not animated")
+		}
+		return wa.animation(), nil
+	default:
+		return nil, fmt.Errorf("unsupported animated image format: %s", format)
+	}
+}
+
+// Resize every frame of an animation, as drawn on the whole canvas
+func resizeAnimation(ctx context.Context, anim *animation, width int) ([]animationFrame, error) {
+	var resized []animationFrame
+	err := anim.render(ctx, func(frame animationFrame) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		frame.image = imaging.Resize(frame.image, width, 0, imaging.Lanczos)
+		resized = append(resized, frame)
+		return nil
+	})
+	return resized, err
+}
+
+// Draw the frames of a GIF. Frames only hold what changed since the one before, so each is drawn
+// onto the canvas, and then its disposal method is applied before the next one is drawn
+func gifAnimation(g *gif.GIF) *animation {
+	// GIF's loop count is how many times it repeats after the first, with -1 for no repeats
+	plays := 0
+	if g.LoopCount != 0 {
+		plays = max(g.LoopCount, 0) + 1
+	}
+
+	return &animation{
+		plays:   plays,
+		palette: gifPalette(g),
+		render: func(ctx context.Context, fn func(frame animationFrame) error) error {
+			canvas := image.NewRGBA(image.Rect(0, 0, g.Config.Width, g.Config.Height))
+			var previous []byte
+
+			for i, frame := range g.Image {
+				var disposal byte
+				if i < len(g.Disposal) {
+					disposal = g.Disposal[i]
+				}
+				if disposal == gif.DisposalPrevious {
+					previous = append(previous[:0], canvas.Pix...)
+				}
+
+				draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+				if err := fn(animationFrame{
+					image: canvas,
+					delay: time.Duration(g.Delay[i]) * 10 * time.Millisecond,
+				}); err != nil {
+					return err
+				}
+
+				switch disposal {
+				case gif.DisposalBackground:
+					// browsers clear to transparent rather than the background colour, so we do too
+					draw.Draw(canvas, frame.Bounds(), image.Transparent, image.Point{}, draw.Src)
+				case gif.DisposalPrevious:
+					copy(canvas.Pix, previous)
+				}
+			}
+			return nil
+		},
+	}
+}
+
+// Get every (opaque) colour a GIF uses, in its global palette and each frame's local one. A frame
+// can leave pixels from earlier frames showing, which may have been drawn with other palettes, so
+// a thumbnail's frames are mapped onto all of them. nil if there are too many for one palette
+func gifPalette(g *gif.GIF) color.Palette {
+	var palettes []color.Palette
+	if global, ok := g.Config.ColorModel.(color.Palette); ok {
+		palettes = append(palettes, global)
+	}
+	for _, frame := range g.Image {
+		palettes = append(palettes, frame.Palette)
+	}
+
+	var union color.Palette
+	seen := make(map[color.NRGBA]bool)
+	for _, palette := range palettes {
+		for _, c := range palette {
+			nc := color.NRGBAModel.Convert(c).(color.NRGBA)
+			if nc.A == 0 || seen[nc] {
+				continue
+			}
+			if len(union) == 256 {
+				return nil
+			}
+			seen[nc] = true
+			union = append(union, nc)
+		}
+	}
+	return union
+}
+
+// Encode resized frames as an animated GIF, mapped onto the source's colours, or onto colours
+// picked from each frame if it had too many. Each frame covers the whole thumbnail, so they are all
+// disposed of to the background (transparent) rather than left for the next one to be drawn over
+func encodeAnimatedGIF(w *bytes.Buffer, frames []animationFrame, plays int, palette color.Palette) error {
+	out := &gif.GIF{
+		Image:    make([]*image.Paletted, len(frames)),
+		Delay:    make([]int, len(frames)),
+		Disposal: make([]byte, len(frames)),
+	}
+	switch {
+	case plays == 1:
+		out.LoopCount = -1
+	case plays > 1:
+		out.LoopCount = plays - 1
+	}
+	for i, frame := range frames {
+		img := frame.image.(*image.NRGBA)
+		framePalette := palette
+		if framePalette == nil {
+			// leaving room for a transparent colour
+			framePalette = medianCut(img, 255)
+		}
+		out.Image[i] = quantize(img, framePalette)
+		out.Delay[i] = int(frame.delay / (10 * time.Millisecond))
+		out.Disposal[i] = gif.DisposalBackground
+	}
+	return gif.EncodeAll(w, out)
+}
+
+// Encode resized frames as a (lossless) animated WebP. As with GIFs, each frame covers the whole
+// thumbnail and is cleared before the next. Browsers show GIF frames of 10ms or less for 100ms, but
+// not WebP ones, so for GIFs those are lengthened so that they don't speed up as WebPs
+func encodeAnimatedWebP(w *bytes.Buffer, frames []animationFrame, plays int, fromGIF bool) error {
+	anim := &nativewebp.Animation{
+		Images:    make([]image.Image, len(frames)),
+		Durations: make([]uint, len(frames)),
+		Disposals: make([]uint, len(frames)),
+		LoopCount: uint16(min(plays, 0xffff)),
+	}
+	for i, frame := range frames {
+		anim.Images[i] = frame.image
+		anim.Durations[i] = uint(frame.delay.Milliseconds())
+		if fromGIF && frame.delay <= 10*time.Millisecond {
+			anim.Durations[i] = 100
+		}
+		anim.Disposals[i] = 1
+	}
+	return nativewebp.EncodeAll(w, anim, nil)
+}
+
+// Map a resized frame onto a palette. Resizing blends neighbouring colours, so each pixel gets the
+// nearest colour in the palette, and pixels that are mostly transparent become the transparent
+// colour. Frames aren't dithered, as the dither pattern would flicker from frame to frame
+func quantize(img *image.NRGBA, palette color.Palette) *image.Paletted {
+	bounds := img.Bounds()
+	out := image.NewPaletted(bounds, palette)
+	uses := make([]int, len(palette))
+	hasTransparent := false
+
+	nearest := make(map[color.NRGBA]uint8)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := img.NRGBAAt(x, y)
+			if c.A < 0x80 {
+				hasTransparent = true
+				continue
+			}
+
+			c.A = 0xff
+			index, ok := nearest[c]
+			if !ok {
+				index = uint8(palette.Index(c))
+				nearest[c] = index
+			}
+			out.SetColorIndex(x, y, index)
+			uses[index]++
+		}
+	}
+
+	if hasTransparent {
+		transparent := addTransparent(img, out, uses)
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				if img.NRGBAAt(x, y).A < 0x80 {
+					out.SetColorIndex(x, y, transparent)
+				}
+			}
+		}
+	}
+	return out
+}
+
+// Give a quantized frame's palette a transparent colour, returning its index. The palette is copied
+// rather than changed, as every frame shares it. If it is already full, the colour the frame uses
+// least makes way, and the pixels that had it are mapped onto the nearest of the rest
+func addTransparent(img *image.NRGBA, out *image.Paletted, uses []int) uint8 {
+	for i, c := range out.Palette {
+		if _, _, _, a := c.RGBA(); a == 0 {
+			return uint8(i)
+		}
+	}
+
+	palette := out.Palette
+	if len(palette) < 256 {
+		out.Palette = append(palette[:len(palette):len(palette)], color.Transparent)
+		return uint8(len(palette))
+	}
+
+	least := 0
+	for i := range uses {
+		if uses[i] < uses[least] {
+			least = i
+		}
+	}
+	out.Palette = append(color.Palette(nil), palette...)
+	// nothing opaque is ever nearer to the transparent colour than to an opaque one
+	out.Palette[least] = color.Transparent
+	if uses[least] > 0 {
+		bounds := img.Bounds()
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				if out.ColorIndexAt(x, y) == uint8(least) {
+					c := img.NRGBAAt(x, y)
+					c.A = 0xff
+					out.SetColorIndex(x, y, uint8(out.Palette.Index(c)))
+				}
+			}
+		}
+	}
+	return uint8(least)
+}
+
+// Pick up to n colours for a frame by median cut: the frame's (opaque) colours start in one box,
+// and the box with the widest spread in any channel is split at its median along that channel
+// until there are n boxes. Each box then gives the average of its colours
+func medianCut(img *image.NRGBA, n int) color.Palette {
+	counts := make(map[color.NRGBA]int)
+	bounds := img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			if c := img.NRGBAAt(x, y); c.A >= 0x80 {
+				c.A = 0xff
+				counts[c]++
+			}
+		}
+	}
+
+	type weighted struct {
+		c     color.NRGBA
+		count int
+	}
+	all := make([]weighted, 0, len(counts))
+	for c, count := range counts {
+		all = append(all, weighted{c, count})
+	}
+	channel := func(c color.NRGBA, ch int) uint8 {
+		return [3]uint8{c.R, c.G, c.B}[ch]
+	}
+	// the channel a box's colours spread furthest along, and how far
+	widest := func(box []weighted) (int, int) {
+		best, bestRange := 0, -1
+		for ch := 0; ch < 3; ch++ {
+			lo, hi := uint8(255), uint8(0)
+			for _, w := range box {
+				lo, hi = min(lo, channel(w.c, ch)), max(hi, channel(w.c, ch))
+			}
+			if r := int(hi) - int(lo); r > bestRange {
+				best, bestRange = ch, r
+			}
+		}
+		return best, bestRange
+	}
+
+	boxes := [][]weighted{all}
+	for len(boxes) < n {
+		split, splitCh, splitRange := -1, 0, 0
+		for i, box := range boxes {
+			if len(box) < 2 {
+				continue
+			}
+			if ch, r := widest(box); r > splitRange {
+				split, splitCh, splitRange = i, ch, r
+			}
+		}
+		if split == -1 {
+			break
+		}
+
+		box := boxes[split]
+		sort.Slice(box, func(i, j int) bool { return channel(box[i].c, splitCh) < channel(box[j].c, splitCh) })
+		total := 0
+		for _, w := range box {
+			total += w.count
+		}
+		// the first colour past half of the box's pixels, keeping at least one on each side
+		at, seen := 1, box[0].count
+		for at < len(box)-1 && seen < total/2 {
+			seen += box[at].count
+			at++
+		}
+		boxes[split] = box[:at]
+		boxes = append(boxes, box[at:])
+	}
+
+	palette := make(color.Palette, 0, len(boxes))
+	for _, box := range boxes {
+		var r, g, b, total int
+		for _, w := range box {
+			r += int(w.c.R) * w.count
+			g += int(w.c.G) * w.count
+			b += int(w.c.B) * w.count
+			total += w.count
+		}
+		if total > 0 {
+			palette = append(palette, color.NRGBA{uint8(r / total), uint8(g / total), uint8(b / total), 0xff})
+		}
+	}
+	// a frame that is entirely transparent still needs a palette
+	if len(palette) == 0 {
+		palette = append(palette, color.Black)
+	}
+	return palette
+}
+
+// Count the frames in a GIF by walking its blocks, without decompressing any of them
+func countGIFFrames(data []byte) (int, error) {
+	// the header and the logical screen descriptor, which may be followed by the global colour table
+	if len(data) < 13 {
+		return 0, errTruncatedGIF
+	}
+	pos := 13 + colorTableSize(data[10])
+
+	frames := 0
+	for {
+		if pos >= len(data) {
+			return 0, errTruncatedGIF
+		}
+
+		switch data[pos] {
+		case 0x21:
+			// an extension: its label, then its sub-blocks
+			var err error
+			if pos, err = skipSubBlocks(data, pos+2); err != nil {
+				return 0, err
+			}
+		case 0x2c:
+			// an image descriptor, its local colour table, the LZW minimum code size, then the image data
+			if pos+10 > len(data) {
+				return 0, errTruncatedGIF
+			}
+			var err error
+			if pos, err = skipSubBlocks(data, pos+10+colorTableSize(data[pos+9])+1); err != nil {
+				return 0, err
+			}
+			frames++
+		case 0x3b:
+			return frames, nil
+		default:
+			return 0, fmt.Errorf("gif: unknown block type 0x%02x", data[pos])
+		}
+	}
+}
+
+// The size of the colour table described by the packed fields of a descriptor, if it has one
+func colorTableSize(packed byte) int {
+	if packed&0x80 == 0 {
+		return 0
+	}
+	return 3 << (packed&0x07 + 1)
+}
+
+// Skip a run of sub-blocks, returning where the block after them starts
+func skipSubBlocks(data []byte, pos int) (int, error) {
+	for {
+		if pos >= len(data) {
+			return 0, errTruncatedGIF
+		}
+		size := int(data[pos])
+		pos++
+		if size == 0 {
+			return pos, nil
+		}
+		pos += size
+	}
+}
@@ -3,155 +3,360 @@ package services
 import (
 	"bytes"
 	"context"
+	"crypto/md5"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"image"
+	"image/color"
 	"image/gif"
 	"image/jpeg"
 	"image/png"
 	"io"
 	"log"
-	"os"
-	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/HugoSmits86/nativewebp"
-	"github.com/aws/smithy-go"
 	"github.com/disintegration/imaging"
+	"github.com/telepedia/thumbra/config"
 	"github.com/telepedia/thumbra/models"
 	"github.com/telepedia/thumbra/storage"
+	"golang.org/x/image/bmp"
+	"golang.org/x/image/tiff"
 )
 
 type ImageService struct {
-	s3Client *storage.S3Client
+	// usually the same backend, unless thumbnails are kept separately
+	originals  storage.Backend
+	thumbnails storage.Backend
+	cfg        *config.Config
+	widths     *widthCache
+	// shared by every sweep, so the [sweeper] rate holds however many are running
+	sweepLimit *rateLimiter
+	usage      *usageCounters
+
+	// background thumbnail uploads, so that shutdown can wait for them
+	uploads   sync.WaitGroup
+	pendingMu sync.Mutex
+	pending   map[string]int
 }
 
+const (
+	// how many times we try to upload a thumbnail before giving up on it, and how long
+	// we wait after the first failure (doubling for each attempt after)
+	uploadAttempts = 3
+	uploadBackoff  = 500 * time.Millisecond
+)
+
 var (
 	ErrImageNotFound = fmt.Errorf("image not found")
-	ErrWidthTooLarge = errors.New("requested width exceeds original image width, caller should return original image")
+	// the thumbnail exists, but wasn't made from the original as it is now, so it should be made again
+	ErrThumbnailStale = fmt.Errorf("thumbnail is out of date")
+	ErrWidthTooLarge  = errors.New("requested width exceeds original image width, caller should apply the oversize policy")
+	// storage has been failing, so its circuit breaker is open and we aren't trying it for now
+	ErrStorageUnavailable = storage.ErrBackendUnavailable
+	// upscaling to the requested width would go past the wiki's max_upscale_width
+	ErrUpscaleTooLarge = errors.New("requested width exceeds the widest an image may be upscaled to")
+	// a page was asked for of a file that doesn't have that many
+	ErrPageNotFound = fmt.Errorf("page not found")
 )
 
-// construct a new image service
-func NewImageService(s3Client *storage.S3Client) *ImageService {
-	return &ImageService{s3Client: s3Client}
+// Returned when a thumbnail is requested wider than the original and the wiki doesn't
+// upscale; it carries the width of the original so the caller can explain the problem
+type WidthTooLargeError struct {
+	Requested int
+	Original  int
 }
 
-// Get the original image from S3. This is used to return the image when the user
-// requests either the original image, or a thumbnail that does not exist so that we can generate
-// a thumbnail for it
-func (is *ImageService) GetOriginalImage(req models.ImageRequest) (*models.ImageResponse, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-	defer cancel()
+func (e *WidthTooLargeError) Error() string {
+	return fmt.Sprintf("requested width %dpx exceeds original image width %dpx", e.Requested, e.Original)
+}
+
+func (e *WidthTooLargeError) Is(target error) bool {
+	return target == ErrWidthTooLarge
+}
+
+// construct a new image service; origin is nil if there is no origin to fall back to
+func NewImageService(originals, thumbnails storage.Backend, origin *storage.Origin, cfg *config.Config) *ImageService {
+	is := &ImageService{
+		originals:  originals,
+		thumbnails: thumbnails,
+		cfg:        cfg,
+		widths:     newWidthCache(),
+		sweepLimit: newRateLimiter(cfg.Sweeper.Rate),
+		usage:      newUsageCounters(),
+		pending:    make(map[string]int),
+	}
+
+	if cfg.Resilience.ServeStale {
+		is.thumbnails = storage.NewStale(thumbnails, int64(cfg.Resilience.StaleCacheSize)<<20)
+	}
+
+	if origin != nil {
+		is.originals = &originFallback{
+			Backend:   originals,
+			origin:    origin,
+			cfg:       cfg,
+			writeBack: is.writeBackOriginal,
+		}
+	}
+
+	return is
+}
 
+// Get what should happen when a thumbnail is requested wider than its original on this wiki
+func (is *ImageService) OversizePolicy(wiki string) string {
+	return is.cfg.OversizePolicy(wiki)
+}
+
+// Check whether a thumbnail would be wider than its original using the width we recorded the last
+// time we decoded the original, so that we don't need to download and decode it again. This is only
+// trusted if the original hasn't changed since; known is false if we don't know the width
+func (is *ImageService) CheckOversize(ctx context.Context, req models.ThumbnailRequest) (tooLarge *WidthTooLargeError, known bool) {
+	requestWidth, err := strconv.Atoi(req.Width)
+	if err != nil {
+		return nil, false
+	}
+
+	entry, found := is.widths.get(widthKey(is.s3KeyForImage(req.ImageRequest()), req))
+	if !found {
+		return nil, false
+	}
+
+	metadata, err := is.GetImageMetadata(ctx, req.ImageRequest())
+	if err != nil || metadata.ETag != entry.etag {
+		return nil, false
+	}
+
+	if requestWidth > entry.width {
+		return &WidthTooLargeError{Requested: requestWidth, Original: entry.width}, true
+	}
+	return nil, true
+}
+
+// Get the original image from S3, streaming it so that it can be returned to the user
+// If br is not nil, only that range of the image is fetched
+func (is *ImageService) GetOriginalImage(ctx context.Context, req models.ImageRequest, br *models.ByteRange) (*models.ImageResponse, error) {
 	s3Key := is.s3KeyForImage(req)
-	return is.fetchObject(ctx, s3Key)
+	return is.fetchObject(ctx, is.originals, s3Key, br)
 }
 
 // Get the metdata about an image from S3; this can handle both archives and latest images
 // it does not handle thumbnails, but it should!
-func (is *ImageService) GetImageMetadata(req models.ImageRequest) (*models.ImageResponse, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+func (is *ImageService) GetImageMetadata(ctx context.Context, req models.ImageRequest) (*models.ImageResponse, error) {
+	ctx, cancel := is.stageContext(ctx, is.cfg.Timeouts.Head)
 	defer cancel()
 
 	s3Key := is.s3KeyForImage(req)
 
-	return is.headObjectByKey(ctx, s3Key)
+	return is.headObjectByKey(ctx, is.originals, s3Key)
 }
 
-// Get the metdata about an image from S3; this can handle both archives and latest images
-// it does not handle thumbnails, but it should!
-func (is *ImageService) GetThumbnailMetadata(req models.ThumbnailRequest) (*models.ImageResponse, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+// Get the metadata about a thumbnail from S3, making sure it is still current. The original is
+// looked up at the same time, so that a thumbnail of an original that has since been replaced
+// (or deleted), or one made by an older generatorVersion, gives ErrThumbnailStale instead.
+// If the original can't be looked up at all, the thumbnail is trusted rather than failing
+func (is *ImageService) GetThumbnailMetadata(ctx context.Context, req models.ThumbnailRequest) (*models.ImageResponse, error) {
+	ctx, cancel := is.stageContext(ctx, is.cfg.Timeouts.Head)
 	defer cancel()
 
-	var s3Key string
-	if req.Revision == "latest" {
-		s3Key = req.GetS3ThumbKey()
-	} else {
-		s3Key = req.GetThumbArchiveKey()
-		log.Println("S3Key", s3Key)
+	var original *models.ImageResponse
+	var originalErr error
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		original, originalErr = is.headObjectByKey(ctx, is.originals, is.s3KeyForImage(req.ImageRequest()))
+	}()
+
+	key := is.s3KeyForThumbnail(req)
+	thumb, err := is.headObjectByKey(ctx, is.thumbnails, key)
+	if err != nil {
+		cancel()
+		<-done
+		return nil, err
+	}
+	<-done
+
+	switch {
+	case errors.Is(originalErr, ErrImageNotFound):
+		// regenerating it will find the original is gone and say so
+		return nil, ErrThumbnailStale
+	case originalErr != nil:
+		log.Printf("couldn't check that thumbnail %s is current, serving it anyway: %v", key, originalErr)
+	case !thumbnailIsCurrent(req, thumb, original):
+		log.Printf("thumbnail %s is out of date, regenerating it", key)
+		return nil, ErrThumbnailStale
 	}
 
-	return is.headObjectByKey(ctx, s3Key)
+	return thumb, nil
 }
 
-// Get the original image from S3. This is used to return the image when the user
-// requests either the original image, or a thumbnail that does not exist so that we can generate
-// a thumbnail for it
-func (is *ImageService) GetThumbnail(req models.ThumbnailRequest) (*models.ImageResponse, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+// Get an existing thumbnail from S3, streaming it so that it can be returned to the user
+// If br is not nil, only that range of the thumbnail is fetched
+func (is *ImageService) GetThumbnail(ctx context.Context, req models.ThumbnailRequest, br *models.ByteRange) (*models.ImageResponse, error) {
+	return is.fetchObject(ctx, is.thumbnails, is.s3KeyForThumbnail(req), br)
+}
+
+// Fetch the original for a thumbnail request and generate the thumbnail, returning the encoded
+// thumbnail held in memory so that it can be written to the caller straight away. The caller
+// is responsible for uploading the thumbnail to S3 (see UploadThumbnailAsync)
+func (is *ImageService) GenerateThumbnail(ctx context.Context, req models.ThumbnailRequest) (*models.GeneratedThumbnail, error) {
+	data, etag, err := is.readOriginal(ctx, req.ImageRequest())
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := is.stageContext(ctx, is.cfg.Timeouts.Process)
 	defer cancel()
 
-	var s3Key string
+	return is.thumbnailImage(ctx, req, data, etag)
+}
 
-	if req.Revision == "latest" {
-		s3Key = req.GetS3ThumbKey()
-	} else {
-		s3Key = req.GetThumbArchiveKey()
+// Read the whole of an original into memory, within the GET stage of the budget. This is the
+// only place the whole of an original is read into memory, since we need all of it to decode it
+func (is *ImageService) readOriginal(ctx context.Context, req models.ImageRequest) ([]byte, string, error) {
+	ctx, cancel := is.stageContext(ctx, is.cfg.Timeouts.Get)
+	defer cancel()
+
+	obj, err := is.getObject(ctx, is.originals, is.s3KeyForImage(req), nil)
+	if err != nil {
+		return nil, "", err
+	}
+	defer obj.Body.Close()
+
+	data, err := io.ReadAll(obj.Body)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read original image: %w", err)
 	}
 
-	return is.fetchObject(ctx, s3Key)
+	return data, obj.ETag, nil
 }
 
-// Take the original image and generate a thumbnail, storing it in the temp dir and returning the path
-// the caller is responsible for uploading the thumbnail to S3 and deleting the temporary file
-// @TODO: investigate whether this function should upload the thumbnail to S3 itself
-func (is *ImageService) ThumbnailImage(req models.ThumbnailRequest, obj *models.ImageResponse) (string, error) {
+// Take the original image and generate a thumbnail. Decoding and resizing can't be interrupted,
+// so the context is checked between each step instead, so that we give up as soon as possible
+// once the client has gone away or the stage has run out of time
+func (is *ImageService) thumbnailImage(ctx context.Context, req models.ThumbnailRequest, data []byte, etag string) (*models.GeneratedThumbnail, error) {
 	// find out what the file type is from the extension
-	ext := strings.ToLower(filepath.Ext(req.Filename))
-	format := strings.TrimPrefix(ext, ".")
+	format := req.SourceFormat()
 
-	// Decode the image
-	img, err := decodeImage(bytes.NewReader(obj.Data), format)
+	requestWidth, err := strconv.Atoi(req.Width)
 	if err != nil {
-		return "", fmt.Errorf("failed to decode original image: %w", err)
+		return nil, fmt.Errorf("error when converting the width to an int: %s", req.Width)
 	}
 
-	origWidth := img.Bounds().Dx()
-	requestWidth, err := strconv.Atoi(req.Width)
+	if format == "tif" || format == "tiff" {
+		if data, err = tiffPage(data, req.Page); err != nil {
+			return nil, err
+		}
+	}
+
+	// only read the header first, so that we don't decode the whole original just to find
+	// out that it is too small; the width is remembered so next time we don't need to fetch it
+	imgCfg, _, err := image.DecodeConfig(bytes.NewReader(data))
 	if err != nil {
-		return "", fmt.Errorf("error when converting the width to an int: %s", req.Width)
+		return nil, fmt.Errorf("failed to decode original image config: %w", err)
 	}
+	is.widths.add(widthKey(is.s3KeyForImage(req.ImageRequest()), req), etag, imgCfg.Width)
 
-	if requestWidth > origWidth {
-		return "", ErrWidthTooLarge
+	// the width is whatever the URL says, so upscaling is limited before anything is decoded
+	if requestWidth > imgCfg.Width {
+		if is.OversizePolicy(req.Wiki) != config.OversizeUpscale {
+			return nil, &WidthTooLargeError{Requested: requestWidth, Original: imgCfg.Width}
+		}
+		if requestWidth > is.MaxUpscaleWidth(req.Wiki) {
+			return nil, ErrUpscaleTooLarge
+		}
 	}
 
-	// do the actual resizing, obviously and write it to the temp directory
-	thumb := imaging.Resize(img, requestWidth, 0, imaging.Lanczos)
+	// animated GIFs and WebPs keep every frame, as long as there aren't too many of them
+	if format == "gif" || format == "webp" {
+		animated, ok, err := is.animatedThumbnail(ctx, data, format, req.OutputFormat(), requestWidth)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			generated := newGeneratedThumbnail(animated, is.ThumbnailContentType(req))
+			generated.SourceETag = etag
+			return generated, nil
+		}
+	}
 
-	tmpFile, err := os.CreateTemp("", "thumb-*"+ext)
+	// Decode the image
+	img, err := decodeImage(bytes.NewReader(data), format)
 	if err != nil {
-		return "", fmt.Errorf("failed to create temp file: %w", err)
+		return nil, fmt.Errorf("failed to decode original image: %w", err)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	// do the actual resizing, obviously
+	thumb := imaging.Resize(img, requestWidth, 0, imaging.Lanczos)
+	if err := ctx.Err(); err != nil {
+		return nil, err
 	}
-	defer tmpFile.Close()
 
-	if err := encodeImage(tmpFile, thumb, format); err != nil {
-		os.Remove(tmpFile.Name())
-		return "", fmt.Errorf("failed to encode thumbnail: %w", err)
+	// JPEG has no transparency, so anything transparent (in a TIFF) is put on white, as MediaWiki does
+	if output := req.OutputFormat(); (output == "jpg" || output == "jpeg") && !thumb.Opaque() {
+		thumb = imaging.Overlay(imaging.New(thumb.Bounds().Dx(), thumb.Bounds().Dy(), color.White), thumb, image.Point{}, 1)
 	}
 
-	return tmpFile.Name(), nil
+	var buf bytes.Buffer
+	if err := encodeImage(&buf, thumb, req.OutputFormat()); err != nil {
+		return nil, fmt.Errorf("failed to encode thumbnail: %w", err)
+	}
+
+	generated := newGeneratedThumbnail(buf.Bytes(), is.ThumbnailContentType(req))
+	generated.SourceETag = etag
+	return generated, nil
+}
+
+// Wrap freshly encoded thumbnail data with the validators it will have once it is in S3. S3 uses
+// the MD5 of the body as the ETag for a single part upload, so the ETag we send now matches the
+// one the caller will see when the thumbnail is later served from S3
+func newGeneratedThumbnail(data []byte, contentType string) *models.GeneratedThumbnail {
+	sum := md5.Sum(data)
+
+	return &models.GeneratedThumbnail{
+		Data:         data,
+		ContentType:  contentType,
+		ETag:         `"` + hex.EncodeToString(sum[:]) + `"`,
+		LastModified: time.Now().UTC().Truncate(time.Second),
+	}
 }
 
 // Decode an image and return it
 func decodeImage(r io.Reader, format string) (image.Image, error) {
 	switch format {
 	case "webp":
-		return nativewebp.Decode(r)
+		return decodeWebP(r)
 	case "jpg", "jpeg":
 		return jpeg.Decode(r)
 	case "png":
 		return png.Decode(r)
 	case "gif":
 		return gif.Decode(r)
+	case "tif", "tiff":
+		return tiff.Decode(r)
+	case "bmp":
+		return bmp.Decode(r)
 	default:
 		return nil, fmt.Errorf("unsupported image format: %s", format)
 	}
 }
 
+// The key the width of an original is remembered under; pages after the first of a multi-page
+// file can be a different size, so they are remembered separately
+func widthKey(key string, req models.ThumbnailRequest) string {
+	if req.Page > 1 {
+		return key + "#page" + strconv.Itoa(req.Page)
+	}
+	return key
+}
+
 // Encode the image with the specified format
 func encodeImage(w io.Writer, img image.Image, format string) error {
 	switch format {
@@ -168,31 +373,152 @@ func encodeImage(w io.Writer, img image.Image, format string) error {
 	}
 }
 
-func (is *ImageService) UploadThumbnail(req models.ThumbnailRequest, filePath string) error {
-	data, err := os.ReadFile(filePath)
-	if err != nil {
-		return fmt.Errorf("failed to read thumbnail file: %w", err)
+// Upload a generated thumbnail to S3 within the upload stage of the budget, retrying with
+// a backoff if S3 has a wobble. It is stored with what it was made from, so that it can be
+// regenerated once that changes (see GetThumbnailMetadata)
+func (is *ImageService) UploadThumbnail(ctx context.Context, req models.ThumbnailRequest, thumb *models.GeneratedThumbnail) error {
+	ctx, cancel := is.stageContext(ctx, is.cfg.Timeouts.Upload)
+	defer cancel()
+
+	key := is.s3KeyForThumbnail(req)
+
+	var err error
+	for attempt := 1; attempt <= uploadAttempts; attempt++ {
+		err = is.thumbnails.Put(ctx, key, thumb.Data, storage.PutOptions{
+			ContentType: thumb.ContentType,
+			Metadata:    thumbnailMetadata(req, thumb.SourceETag),
+		})
+		if err == nil {
+			is.usage.add(req.Wiki, req.Width, int64(len(thumb.Data)), 1)
+			return nil
+		}
+
+		if attempt < uploadAttempts {
+			log.Printf("failed to upload thumbnail %s (attempt %d of %d): %v", key, attempt, uploadAttempts, err)
+			select {
+			case <-time.After(uploadBackoff * time.Duration(1<<(attempt-1))):
+			case <-ctx.Done():
+				return fmt.Errorf("gave up uploading thumbnail to storage: %w", ctx.Err())
+			}
+		}
 	}
 
-	// try get the content type from the extension
-	ext := strings.ToLower(filepath.Ext(req.Filename))
-	contentType := getContentType(ext)
+	return fmt.Errorf("failed to upload thumbnail to storage after %d attempts: %w", uploadAttempts, err)
+}
 
-	var key string
+// Upload a generated thumbnail to S3 in the background, so that the caller can return the
+// thumbnail without waiting on S3. Failures are only logged; the thumbnail will just be
+// generated again on the next request
+// The thumbnail is finished by the time we get here, so the upload isn't abandoned when the
+// client goes away, only when it runs out of its share of the budget
+func (is *ImageService) UploadThumbnailAsync(ctx context.Context, req models.ThumbnailRequest, thumb *models.GeneratedThumbnail) {
+	ctx = context.WithoutCancel(ctx)
+
+	is.inBackground(is.s3KeyForThumbnail(req), func() {
+		if err := is.UploadThumbnail(ctx, req, thumb); err != nil {
+			log.Printf("Failed to upload thumbnail to storage: %v", err)
+		}
+	})
+}
 
-	if req.Revision == "latest" {
-		key = is.s3KeyForThumbnail(req)
-	} else {
-		key = is.s3KeyForThumbnail(req)
+// Copy an original that was fetched from the origin into storage in the background, so that
+// it's served from storage from now on. This is only tried once; if it fails the original is
+// just fetched from the origin again next time
+func (is *ImageService) writeBackOriginal(key string, data []byte, contentType, etag string) {
+	is.inBackground(key, func() {
+		ctx, cancel := is.stageContext(context.Background(), is.cfg.Timeouts.Upload)
+		defer cancel()
+
+		opts := storage.PutOptions{ContentType: contentType}
+		if etag != "" {
+			opts.Metadata = map[string]string{metaOriginETag: etag}
+		}
+		if err := is.originals.Put(ctx, key, data, opts); err != nil {
+			log.Printf("Failed to write %s back into storage: %v", key, err)
+			return
+		}
+		log.Printf("wrote %s back into storage", key)
+	})
+}
+
+// Run an upload in the background, keeping track of it so that shutdown can wait for it
+func (is *ImageService) inBackground(key string, upload func()) {
+	is.uploads.Add(1)
+	is.pendingMu.Lock()
+	is.pending[key]++
+	is.pendingMu.Unlock()
+
+	go func() {
+		defer func() {
+			is.pendingMu.Lock()
+			if is.pending[key]--; is.pending[key] == 0 {
+				delete(is.pending, key)
+			}
+			is.pendingMu.Unlock()
+			is.uploads.Done()
+		}()
+
+		upload()
+	}()
+}
+
+// Wait for background uploads to finish, for use when shutting down. If ctx is done first
+// the keys of the uploads that are still pending are returned, so that they can be logged
+func (is *ImageService) WaitForUploads(ctx context.Context) []string {
+	done := make(chan struct{})
+	go func() {
+		is.uploads.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
 	}
 
-	// Upload to S3
-	err = is.s3Client.PutObject(context.Background(), key, data, contentType)
-	if err != nil {
-		return fmt.Errorf("failed to upload thumbnail to S3: %w", err)
+	is.pendingMu.Lock()
+	defer is.pendingMu.Unlock()
+
+	keys := make([]string, 0, len(is.pending))
+	for key := range is.pending {
+		keys = append(keys, key)
 	}
+	return keys
+}
+
+// Get the content type that a thumbnail for this request will be served with
+func (is *ImageService) ThumbnailContentType(req models.ThumbnailRequest) string {
+	return getContentType(req.OutputFormat())
+}
+
+// The token admin requests must send, or empty if the admin API is turned off
+func (is *ImageService) AdminToken() string {
+	return is.cfg.Admin.Token
+}
+
+// Whether orphaned thumbnails are moved to quarantine rather than deleted
+func (is *ImageService) QuarantineOrphans() bool {
+	return is.cfg.Sweeper.Quarantine
+}
 
-	return nil
+// Whether thumbnails should be sized using the client hints sent by browsers
+func (is *ImageService) ClientHintsEnabled() bool {
+	return is.cfg.Thumbnails.ClientHints
+}
+
+// The widest a thumbnail on this wiki may be upscaled to
+func (is *ImageService) MaxUpscaleWidth(wiki string) int {
+	return is.cfg.MaxUpscaleWidth(wiki)
+}
+
+// Get the formats, in order of preference, that thumbnails on this wiki may be negotiated to
+func (is *ImageService) ThumbnailFormats(wiki string) []string {
+	return is.cfg.ThumbnailFormats(wiki)
+}
+
+func (is *ImageService) TranscodeGIF(wiki string) bool {
+	return is.cfg.TranscodeGIF(wiki)
 }
 
 // utility function to get the S3 key for either latest or archive images
@@ -211,31 +537,72 @@ func (is *ImageService) s3KeyForThumbnail(req models.ThumbnailRequest) string {
 	return req.GetThumbArchiveKey()
 }
 
-// wrapper around S3 GetObject that returns errors that Thumbra can understand
-func (is *ImageService) fetchObject(ctx context.Context, key string) (*models.ImageResponse, error) {
-	obj, err := is.s3Client.GetObject(ctx, key)
-	if err != nil {
-		if err == storage.ErrObjectNotFound {
-			return nil, ErrImageNotFound
+// Derive the context for one stage of a request from its parent, so that the stage is
+// abandoned either when it has used up its share of the budget or when the client goes away
+func (is *ImageService) stageContext(ctx context.Context, percent int) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, is.cfg.Timeouts.Stage(percent))
+}
+
+// Fetch an object so that it can be streamed to the client. The GET stage of the budget only
+// covers S3 starting to respond; the body is then streamed for as long as the client keeps
+// reading it, but is still abandoned as soon as the client goes away (ie the request context
+// is cancelled). The context is released when the caller closes the body
+func (is *ImageService) fetchObject(ctx context.Context, backend storage.Backend, key string, br *models.ByteRange) (*models.ImageResponse, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	timer := time.AfterFunc(is.cfg.Timeouts.Stage(is.cfg.Timeouts.Get), cancel)
+
+	obj, err := is.getObject(ctx, backend, key, br)
+	if !timer.Stop() {
+		// the stage ran out of time, either before S3 responded or just after
+		if err == nil {
+			obj.Body.Close()
 		}
-		return nil, fmt.Errorf("failed to retrieve image from S3: %w", err)
+		cancel()
+		return nil, fmt.Errorf("failed to retrieve image from storage: %w", context.DeadlineExceeded)
+	}
+	if err != nil {
+		cancel()
+		return nil, err
 	}
+
+	obj.Body = &cancelOnClose{ReadCloser: obj.Body, cancel: cancel}
 	return obj, nil
 }
 
-// Wrapper for S3 HeadObject to get metadata about an object
-// returns errors that Thumbra can understand (since the S3 api is weird)
-func (is *ImageService) headObjectByKey(ctx context.Context, key string) (*models.ImageResponse, error) {
-	metadata, err := is.s3Client.HeadObject(ctx, key)
+// wrapper around the backend's Get that returns errors that Thumbra can understand
+func (is *ImageService) getObject(ctx context.Context, backend storage.Backend, key string, br *models.ByteRange) (*models.ImageResponse, error) {
+	obj, err := backend.Get(ctx, key, br)
 	if err != nil {
-		var apiErr smithy.APIError
-		if errors.As(err, &apiErr) && apiErr.ErrorCode() == "NotFound" {
+		if errors.Is(err, storage.ErrObjectNotFound) {
 			return nil, ErrImageNotFound
 		}
-		if err == storage.ErrObjectNotFound {
+		return nil, fmt.Errorf("failed to retrieve image from storage: %w", err)
+	}
+	return obj, nil
+}
+
+// Ties the lifetime of a context to the body of an object so that it isn't
+// cancelled before the caller has finished streaming it
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
+
+// Wrapper for the backend's Head to get metadata about an object
+// returns errors that Thumbra can understand
+func (is *ImageService) headObjectByKey(ctx context.Context, backend storage.Backend, key string) (*models.ImageResponse, error) {
+	metadata, err := backend.Head(ctx, key)
+	if err != nil {
+		if errors.Is(err, storage.ErrObjectNotFound) {
 			return nil, ErrImageNotFound
 		}
-		return nil, fmt.Errorf("failed to retrieve image metadata from S3: %w", err)
+		return nil, fmt.Errorf("failed to retrieve image metadata from storage: %w", err)
 	}
 	return metadata, nil
 }
@@ -250,6 +617,10 @@ func getContentType(ext string) string {
 		return "image/gif"
 	case "webp":
 		return "image/webp"
+	case "tif", "tiff":
+		return "image/tiff"
+	case "bmp":
+		return "image/bmp"
 	default:
 		// might need to forgoe this if we can't understand the
 		// conent type, return errrorrrrrrrr?
@@ -0,0 +1,159 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"strings"
+
+	"github.com/telepedia/thumbra/config"
+	"github.com/telepedia/thumbra/models"
+	"github.com/telepedia/thumbra/storage"
+)
+
+// Returned (wrapped) when the origin fails for an original that isn't in storage. This must not
+// be treated as the file not existing, as it most likely does and we just couldn't get it
+var ErrOriginUnavailable = fmt.Errorf("origin unavailable")
+
+// Originals written back from the origin are stored with the ETag the origin gave them, as the
+// backend gives them an ETag of its own (an MD5 of the contents) that thumbnails made while the
+// file was on the origin don't know about
+const metaOriginETag = "thumbra-origin-etag"
+
+// Wraps the originals backend so that originals it doesn't have are fetched from the origin
+// instead, for wikis that have the origin turned on. Everything else goes straight to the backend
+type originFallback struct {
+	storage.Backend
+	origin *storage.Origin
+	cfg    *config.Config
+	// copies an original fetched from the origin into the backend, recording the origin's ETag
+	writeBack func(key string, data []byte, contentType, etag string)
+}
+
+func (of *originFallback) Get(ctx context.Context, key string, br *models.ByteRange) (*models.ImageResponse, error) {
+	obj, err := of.Backend.Get(ctx, key, br)
+	if err == nil {
+		return withOriginETag(obj), nil
+	}
+	if !errors.Is(err, storage.ErrObjectNotFound) || !of.enabled(key) {
+		return obj, err
+	}
+
+	obj, err = of.origin.Get(ctx, key, br)
+	if err != nil {
+		return nil, originError(err)
+	}
+	log.Printf("fetched %s from the origin", key)
+
+	// a range isn't the whole file, so only a full GET can be written back
+	if of.cfg.Origin.WriteBack && br == nil && obj.ContentRange == "" {
+		limit := int64(of.cfg.Origin.WriteBackLimit) << 20
+		if obj.Length > limit {
+			log.Printf("not writing %s back into storage, it is bigger than %dMB", key, of.cfg.Origin.WriteBackLimit)
+		} else {
+			contentType := obj.ContentType
+			if contentType == "" {
+				contentType = getContentType(path.Ext(key))
+			}
+			etag := obj.ETag
+			obj.Body = &writeBackBody{
+				ReadCloser: obj.Body,
+				length:     obj.Length,
+				limit:      limit,
+				done: func(data []byte) {
+					of.writeBack(key, data, contentType, etag)
+				},
+			}
+		}
+	}
+
+	return obj, nil
+}
+
+func (of *originFallback) Head(ctx context.Context, key string) (*models.ImageResponse, error) {
+	obj, err := of.Backend.Head(ctx, key)
+	if err == nil {
+		return withOriginETag(obj), nil
+	}
+	if !errors.Is(err, storage.ErrObjectNotFound) || !of.enabled(key) {
+		return obj, err
+	}
+
+	obj, err = of.origin.Head(ctx, key)
+	if err != nil {
+		return nil, originError(err)
+	}
+	return obj, nil
+}
+
+// Give an original that was written back from the origin the ETag it had there, so that the
+// thumbnails (and widths) recorded against that ETag are still current once it has moved. This is
+// done whether or not the wiki still uses the origin, as it is true of the file either way. Backends
+// that can't store metadata (the filesystem) give the written back copy its new ETag instead
+func withOriginETag(obj *models.ImageResponse) *models.ImageResponse {
+	if etag := obj.Metadata[metaOriginETag]; etag != "" {
+		obj.ETag = etag
+	}
+	return obj
+}
+
+// Whether the wiki the key belongs to uses the origin
+func (of *originFallback) enabled(key string) bool {
+	wiki, _, _ := strings.Cut(key, "/")
+	return of.cfg.OriginEnabled(wiki)
+}
+
+// A file missing from the origin is missing, but any other failure is the origin's problem
+func originError(err error) error {
+	if errors.Is(err, storage.ErrObjectNotFound) || errors.Is(err, storage.ErrInvalidRange) {
+		return err
+	}
+	return fmt.Errorf("%w: %w", ErrOriginUnavailable, err)
+}
+
+// Keeps a copy of an original as it is streamed from the origin, and hands it over once it has
+// been read to the end. Nothing is handed over if the client goes away part of the way through,
+// the origin sends less than it said it would, or the file turns out to be bigger than the limit
+type writeBackBody struct {
+	io.ReadCloser
+	// -1 if the origin didn't say
+	length int64
+	limit  int64
+	done   func(data []byte)
+
+	buf      bytes.Buffer
+	complete bool
+	tooBig   bool
+}
+
+func (wb *writeBackBody) Read(p []byte) (int, error) {
+	n, err := wb.ReadCloser.Read(p)
+
+	if !wb.tooBig {
+		if int64(wb.buf.Len()+n) > wb.limit {
+			wb.tooBig = true
+			wb.buf = bytes.Buffer{}
+		} else {
+			wb.buf.Write(p[:n])
+		}
+	}
+	if err == io.EOF {
+		wb.complete = true
+	}
+
+	return n, err
+}
+
+func (wb *writeBackBody) Close() error {
+	err := wb.ReadCloser.Close()
+
+	if wb.complete && !wb.tooBig && (wb.length < 0 || int64(wb.buf.Len()) == wb.length) {
+		wb.done(wb.buf.Bytes())
+	}
+
+	return err
+}
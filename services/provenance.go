@@ -0,0 +1,57 @@
+package services
+
+import (
+	"strconv"
+
+	"github.com/telepedia/thumbra/models"
+)
+
+// Bump this whenever a change to how thumbnails are made (resampling, encoder settings, ...) should
+// replace the thumbnails that are already stored. Nothing is purged; thumbnails made by an older
+// version are regenerated the next time they are requested
+const generatorVersion = "1"
+
+// The user metadata thumbnails are stored with, recording what they were made from and how
+const (
+	metaSourceETag = "thumbra-source-etag"
+	metaTransform  = "thumbra-transform"
+	metaVersion    = "thumbra-version"
+)
+
+// Build the metadata to store with a thumbnail made from the original with the given ETag
+func thumbnailMetadata(req models.ThumbnailRequest, sourceETag string) map[string]string {
+	return map[string]string{
+		metaSourceETag: sourceETag,
+		metaTransform:  transformFor(req),
+		metaVersion:    generatorVersion,
+	}
+}
+
+// Describe how a thumbnail is made from its original. Both of these are in the key as well, but
+// this means a thumbnail copied (or renamed) to the wrong key is noticed too
+func transformFor(req models.ThumbnailRequest) string {
+	transform := "width=" + req.Width + ";format=" + req.OutputFormat()
+	// GIF thumbnails used to only have the first frame, so this makes those be made again
+	if req.OutputFormat() == "gif" {
+		transform += ";animated"
+	}
+	if req.Page > 1 {
+		transform += ";page=" + strconv.Itoa(req.Page)
+	}
+	return transform
+}
+
+// Whether a stored thumbnail was made from the original as it is now, by this version of Thumbra.
+// Thumbnails without any metadata were made by MediaWiki, by Thumbra before it recorded any, or are
+// kept somewhere that can't store it (the filesystem); all we can go on for those is whether the
+// original has been modified since the thumbnail was
+func thumbnailIsCurrent(req models.ThumbnailRequest, thumb, original *models.ImageResponse) bool {
+	meta := thumb.Metadata
+	if meta[metaVersion] == "" {
+		return thumb.LastModified.IsZero() || !original.LastModified.After(thumb.LastModified)
+	}
+
+	return meta[metaVersion] == generatorVersion &&
+		meta[metaSourceETag] == original.ETag &&
+		meta[metaTransform] == transformFor(req)
+}
@@ -0,0 +1,150 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/telepedia/thumbra/models"
+	"github.com/telepedia/thumbra/storage"
+)
+
+// The revision to purge to remove the thumbnails of every revision of a file at once
+const PurgeAllRevisions = "all"
+
+// how many keys to list at a time when looking for a file's thumbnails
+const purgeListLimit = 1000
+
+// What a purge removed, and what it made again afterwards
+type PurgeReport struct {
+	Removed     []string `json:"removed"`
+	Regenerated []string `json:"regenerated,omitempty"`
+	// the widths that couldn't be regenerated, and why
+	Failed map[string]string `json:"failed,omitempty"`
+}
+
+// Delete every thumbnail of a file: of the latest version, one archived revision (by its
+// timestamp), or with PurgeAllRevisions, all of them. If regenerate is set, the standard widths
+// from the [admin] config are made again afterwards for the latest version (or the archived
+// revision that was purged). The report covers everything removed even if the purge fails
+// part of the way through
+func (is *ImageService) PurgeThumbnails(ctx context.Context, req models.ImageRequest, regenerate bool) (*PurgeReport, error) {
+	report := &PurgeReport{Removed: []string{}}
+
+	objects, err := is.thumbnailObjects(ctx, req)
+	if err != nil {
+		return report, fmt.Errorf("failed to list thumbnails: %w", err)
+	}
+
+	// thumbnails still being uploaded in the background can land after this; they are made
+	// from the original as it is now, so they are no worse than regenerating them
+	for _, obj := range objects {
+		if err := is.thumbnails.Delete(ctx, obj.Key); err != nil {
+			return report, fmt.Errorf("failed to delete thumbnail %s: %w", obj.Key, err)
+		}
+		is.usage.add(req.Wiki, thumbnailWidth(obj.Key), -obj.Size, -1)
+		report.Removed = append(report.Removed, obj.Key)
+	}
+	log.Printf("purged %d thumbnails of %s (revision %s)", len(report.Removed), req.GetS3Key(), req.Revision)
+
+	if regenerate {
+		if req.Revision == PurgeAllRevisions {
+			req.Revision = "latest"
+		}
+		is.regenerateThumbnails(ctx, req, report)
+	}
+
+	return report, nil
+}
+
+// Find the thumbnails to purge
+func (is *ImageService) thumbnailObjects(ctx context.Context, req models.ImageRequest) ([]storage.ObjectInfo, error) {
+	switch req.Revision {
+	case "latest":
+		return is.listObjects(ctx, req.GetThumbPrefix(), nil)
+	case PurgeAllRevisions:
+		latest, err := is.listObjects(ctx, req.GetThumbPrefix(), nil)
+		if err != nil {
+			return nil, err
+		}
+
+		// archived revisions are in a directory each (TIMESTAMP!filename), next to those
+		// of every other file with the same hash, so only keep the ones for this file
+		dir := fmt.Sprintf("%s/thumb/archive/%s/%s/", req.Wiki, req.Hash1, req.Hash2)
+		archived, err := is.listObjects(ctx, dir, func(key string) bool {
+			revision, _, _ := strings.Cut(strings.TrimPrefix(key, dir), "/")
+			return strings.HasSuffix(revision, "!"+req.Filename)
+		})
+		if err != nil {
+			return nil, err
+		}
+		return append(latest, archived...), nil
+	default:
+		return is.listObjects(ctx, req.GetThumbArchivePrefix(), nil)
+	}
+}
+
+// List every object under a prefix in the thumbnail backend, keeping only those whose key
+// keep returns true for if it isn't nil
+func (is *ImageService) listObjects(ctx context.Context, prefix string, keep func(key string) bool) ([]storage.ObjectInfo, error) {
+	objects := []storage.ObjectInfo{}
+	cursor := ""
+	for {
+		page, err := is.thumbnails.List(ctx, prefix, cursor, purgeListLimit)
+		if err != nil {
+			return nil, err
+		}
+		for _, obj := range page.Objects {
+			if keep == nil || keep(obj.Key) {
+				objects = append(objects, obj)
+			}
+		}
+		if cursor = page.NextCursor; cursor == "" {
+			return objects, nil
+		}
+	}
+}
+
+// Make the standard widths of a file again, one at a time, recording how each one went.
+// Widths bigger than the original are skipped unless the wiki upscales
+func (is *ImageService) regenerateThumbnails(ctx context.Context, req models.ImageRequest, report *PurgeReport) {
+	for _, width := range is.cfg.Admin.StandardWidths {
+		thumbReq := models.ThumbnailRequest{
+			Wiki:     req.Wiki,
+			Hash1:    req.Hash1,
+			Hash2:    req.Hash2,
+			Filename: req.Filename,
+			Revision: req.Revision,
+			Width:    strconv.Itoa(width),
+		}
+
+		thumb, err := is.GenerateThumbnail(ctx, thumbReq)
+		if err == nil {
+			err = is.UploadThumbnail(ctx, thumbReq, thumb)
+		}
+
+		switch {
+		case err == nil:
+			report.Regenerated = append(report.Regenerated, is.s3KeyForThumbnail(thumbReq))
+			continue
+		case errors.Is(err, ErrWidthTooLarge):
+			err = fmt.Errorf("wider than the original")
+		case errors.Is(err, ErrImageNotFound):
+			err = fmt.Errorf("the original does not exist")
+		default:
+			log.Printf("failed to regenerate %s: %v", is.s3KeyForThumbnail(thumbReq), err)
+		}
+
+		if report.Failed == nil {
+			report.Failed = make(map[string]string)
+		}
+		report.Failed[thumbReq.Width] = err.Error()
+
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,401 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/telepedia/thumbra/models"
+	"github.com/telepedia/thumbra/storage"
+	"github.com/telepedia/thumbra/utils"
+)
+
+const (
+	// how many thumbnails a sweep looks at when it isn't told, and the most it will look at
+	// in one go; the background sweeper saves its cursor after every batch of this many
+	SweepDefaultLimit = 1000
+	SweepMaxLimit     = 10000
+
+	// how many keys to list at a time when sweeping
+	sweepPageSize = 1000
+)
+
+// What a sweep of a wiki's thumbnails found. Orphans are the thumbnails whose original no longer
+// exists, which have been removed unless it was a dry run. NextCursor is where to carry on from,
+// and is empty once the whole wiki has been swept
+type SweepReport struct {
+	Wiki       string   `json:"wiki"`
+	DryRun     bool     `json:"dry_run"`
+	Thumbnails int      `json:"thumbnails"`
+	Checked    int      `json:"originals_checked"`
+	Orphans    []string `json:"orphans"`
+	Bytes      int64    `json:"orphaned_bytes"`
+	// keys under thumb/ that aren't laid out like thumbnails, which are left alone
+	Skipped    int    `json:"skipped"`
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+type SweepOptions struct {
+	// the NextCursor of the last sweep, or empty to start from the beginning
+	Cursor string
+	// how many thumbnails to look at before stopping
+	Limit  int
+	DryRun bool
+	// move orphans to {wiki}/quarantine/ rather than deleting them
+	Quarantine bool
+}
+
+// Look through a wiki's thumbnails (both thumb/ and thumb/archive/) in key order, and remove those
+// whose original has gone. Each thumbnail directory's original is only looked up once, and all of
+// the sweeper's storage calls are spaced out by the rate in the [sweeper] config. If the sweep
+// fails part of the way through, the report still says what was done, and its NextCursor carries
+// on from the last thumbnail that was dealt with
+func (is *ImageService) SweepOrphans(ctx context.Context, wiki string, opts SweepOptions) (*SweepReport, error) {
+	report := &SweepReport{Wiki: wiki, DryRun: opts.DryRun, Orphans: []string{}}
+	prefix := wiki + "/thumb/"
+	cursor := opts.Cursor
+
+	// the directory we last looked up the original of, and whether it was orphaned
+	lastDir := ""
+	orphaned := false
+
+	for report.Thumbnails+report.Skipped < opts.Limit {
+		page, err := is.sweepList(ctx, prefix, cursor, min(sweepPageSize, opts.Limit-report.Thumbnails-report.Skipped))
+		if err != nil {
+			return report, fmt.Errorf("failed to list thumbnails: %w", err)
+		}
+
+		for _, obj := range page.Objects {
+			req, ok := thumbnailOriginal(obj.Key)
+			if !ok {
+				report.Skipped++
+				report.NextCursor = obj.Key
+				continue
+			}
+
+			if dir := path.Dir(obj.Key); dir != lastDir {
+				if orphaned, err = is.isOrphan(ctx, req); err != nil {
+					return report, err
+				}
+				lastDir = dir
+				report.Checked++
+			}
+
+			if orphaned {
+				if !opts.DryRun {
+					if err := is.removeOrphan(ctx, obj.Key, opts.Quarantine); err != nil {
+						return report, fmt.Errorf("failed to remove orphaned thumbnail %s: %w", obj.Key, err)
+					}
+					is.usage.add(wiki, thumbnailWidth(obj.Key), -obj.Size, -1)
+				}
+				report.Orphans = append(report.Orphans, obj.Key)
+				report.Bytes += obj.Size
+			}
+
+			report.Thumbnails++
+			report.NextCursor = obj.Key
+		}
+
+		if cursor = page.NextCursor; cursor == "" {
+			report.NextCursor = ""
+			break
+		}
+	}
+
+	return report, nil
+}
+
+// Work out which original a thumbnail was made from using its key: metawiki/thumb/a/a0/Foo.png/120px-Foo.png
+// is of metawiki/a/a0/Foo.png, and metawiki/thumb/archive/a/a0/20250818122033!Foo.png/120px-Foo.png is of that
+// archived revision. ok is false for anything else under thumb/, ie MediaWiki's thumb/temp/
+func thumbnailOriginal(key string) (req models.ImageRequest, ok bool) {
+	parts := strings.Split(key, "/")
+
+	switch {
+	case len(parts) == 6 && parts[1] == "thumb":
+		req = models.ImageRequest{Wiki: parts[0], Hash1: parts[2], Hash2: parts[3], Filename: parts[4], Revision: "latest"}
+	case len(parts) == 7 && parts[1] == "thumb" && parts[2] == "archive":
+		revision, filename, found := strings.Cut(parts[5], "!")
+		if !found {
+			return req, false
+		}
+		req = models.ImageRequest{Wiki: parts[0], Hash1: parts[3], Hash2: parts[4], Filename: filename, Revision: revision}
+	default:
+		return req, false
+	}
+
+	return req, utils.ValidateImageRequest(req) == nil
+}
+
+func (is *ImageService) sweepList(ctx context.Context, prefix, cursor string, limit int) (*storage.ListPage, error) {
+	if err := is.sweepLimit.wait(ctx); err != nil {
+		return nil, err
+	}
+	ctx, cancel := is.stageContext(ctx, is.cfg.Timeouts.Get)
+	defer cancel()
+
+	return is.thumbnails.List(ctx, prefix, cursor, limit)
+}
+
+// Whether an original has gone. Anything other than the original not existing is an error,
+// as we can't tell, and a thumbnail must never be removed because storage had a wobble
+func (is *ImageService) isOrphan(ctx context.Context, req models.ImageRequest) (bool, error) {
+	if err := is.sweepLimit.wait(ctx); err != nil {
+		return false, err
+	}
+
+	_, err := is.GetImageMetadata(ctx, req)
+	switch {
+	case err == nil:
+		return false, nil
+	case errors.Is(err, ErrImageNotFound):
+		return true, nil
+	default:
+		return false, fmt.Errorf("failed to check whether %s exists: %w", is.s3KeyForImage(req), err)
+	}
+}
+
+// Delete an orphaned thumbnail, copying it into quarantine first if asked to
+func (is *ImageService) removeOrphan(ctx context.Context, key string, quarantine bool) error {
+	if quarantine {
+		if err := is.quarantine(ctx, key); err != nil {
+			return err
+		}
+	}
+
+	if err := is.sweepLimit.wait(ctx); err != nil {
+		return err
+	}
+	ctx, cancel := is.stageContext(ctx, is.cfg.Timeouts.Upload)
+	defer cancel()
+
+	return is.thumbnails.Delete(ctx, key)
+}
+
+// Copy a thumbnail to {wiki}/quarantine/thumb/..., where it is out of the way but can still be
+// put back by hand if it turns out it was needed
+func (is *ImageService) quarantine(ctx context.Context, key string) error {
+	if err := is.sweepLimit.wait(ctx); err != nil {
+		return err
+	}
+	data, obj, err := is.readThumbnail(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	if err := is.sweepLimit.wait(ctx); err != nil {
+		return err
+	}
+	ctx, cancel := is.stageContext(ctx, is.cfg.Timeouts.Upload)
+	defer cancel()
+
+	wiki, rest, _ := strings.Cut(key, "/")
+	return is.thumbnails.Put(ctx, wiki+"/quarantine/"+rest, data, storage.PutOptions{
+		ContentType: obj.ContentType,
+		Metadata:    obj.Metadata,
+	})
+}
+
+func (is *ImageService) readThumbnail(ctx context.Context, key string) ([]byte, *models.ImageResponse, error) {
+	ctx, cancel := is.stageContext(ctx, is.cfg.Timeouts.Get)
+	defer cancel()
+
+	obj, err := is.getObject(ctx, is.thumbnails, key, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer obj.Body.Close()
+
+	data, err := io.ReadAll(obj.Body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read thumbnail: %w", err)
+	}
+	return data, obj, nil
+}
+
+// Sweep the wikis in the [sweeper] config one after another, then wait for the interval and start
+// again, until ctx is done. How far it has got is saved to the cursor file after every batch, so
+// that a restart carries on from there rather than starting from the beginning
+func (is *ImageService) RunSweeper(ctx context.Context) {
+	interval := time.Duration(is.cfg.Sweeper.Interval) * time.Hour
+
+	for {
+		if err := is.sweepWikis(ctx); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("Sweep failed, carrying on from where it stopped in %s: %v", interval, err)
+		}
+
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (is *ImageService) sweepWikis(ctx context.Context) error {
+	cfg := is.cfg.Sweeper
+	saved := is.loadSweepCursor()
+
+	// start again from the beginning if the wiki we were on isn't being swept any more
+	start := slices.Index(cfg.Wikis, saved.Wiki)
+	if start < 0 {
+		start = 0
+		saved = sweepCursor{}
+	} else {
+		log.Printf("Resuming the sweep of %s from %q", saved.Wiki, saved.Cursor)
+	}
+
+	for i, wiki := range cfg.Wikis[start:] {
+		cursor := ""
+		if wiki == saved.Wiki {
+			cursor = saved.Cursor
+		}
+
+		orphans, bytes := 0, int64(0)
+		for {
+			report, err := is.SweepOrphans(ctx, wiki, SweepOptions{
+				Cursor:     cursor,
+				Limit:      SweepDefaultLimit,
+				DryRun:     cfg.DryRun,
+				Quarantine: cfg.Quarantine,
+			})
+			for _, key := range report.Orphans {
+				if cfg.DryRun {
+					log.Printf("Found orphaned thumbnail %s", key)
+				} else {
+					log.Printf("Removed orphaned thumbnail %s", key)
+				}
+			}
+			orphans += len(report.Orphans)
+			bytes += report.Bytes
+
+			if err != nil {
+				if report.NextCursor != "" {
+					is.saveSweepCursor(sweepCursor{Wiki: wiki, Cursor: report.NextCursor})
+				}
+				return fmt.Errorf("%s: %w", wiki, err)
+			}
+			if cursor = report.NextCursor; cursor == "" {
+				break
+			}
+			is.saveSweepCursor(sweepCursor{Wiki: wiki, Cursor: cursor})
+		}
+
+		log.Printf("Swept %s: %d orphaned thumbnails (%d bytes)", wiki, orphans, bytes)
+		if next := start + i + 1; next < len(cfg.Wikis) {
+			is.saveSweepCursor(sweepCursor{Wiki: cfg.Wikis[next]})
+		}
+	}
+
+	is.saveSweepCursor(sweepCursor{})
+	return nil
+}
+
+// How far the background sweeper has got
+type sweepCursor struct {
+	Wiki   string `json:"wiki"`
+	Cursor string `json:"cursor"`
+}
+
+func (is *ImageService) loadSweepCursor() sweepCursor {
+	var cursor sweepCursor
+	file := is.cfg.Sweeper.CursorFile
+	if file == "" {
+		return cursor
+	}
+
+	data, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return cursor
+	}
+	if err == nil {
+		err = json.Unmarshal(data, &cursor)
+	}
+	if err != nil {
+		log.Printf("Failed to read the sweeper cursor, starting from the beginning: %v", err)
+		return sweepCursor{}
+	}
+	return cursor
+}
+
+// Save the cursor by writing it next to the file and renaming it into place, so that
+// stopping part of the way through can't leave a broken cursor behind
+func (is *ImageService) saveSweepCursor(cursor sweepCursor) {
+	file := is.cfg.Sweeper.CursorFile
+	if file == "" {
+		return
+	}
+
+	data, _ := json.Marshal(cursor)
+	tmp, err := os.CreateTemp(filepath.Dir(file), ".sweeper-")
+	if err == nil {
+		_, err = tmp.Write(data)
+		if closeErr := tmp.Close(); err == nil {
+			err = closeErr
+		}
+		if err == nil {
+			err = os.Rename(tmp.Name(), file)
+		}
+		if err != nil {
+			os.Remove(tmp.Name())
+		}
+	}
+	if err != nil {
+		log.Printf("Failed to save the sweeper cursor: %v", err)
+	}
+}
+
+// Spaces calls out so that there are no more than a given number a second, shared by every
+// sweep that is running so that an on-demand sweep doesn't double the load of the background one
+type rateLimiter struct {
+	// zero for no limit
+	interval time.Duration
+
+	mu   sync.Mutex
+	next time.Time
+}
+
+func newRateLimiter(rate int) *rateLimiter {
+	if rate <= 0 {
+		return &rateLimiter{}
+	}
+	return &rateLimiter{interval: time.Second / time.Duration(rate)}
+}
+
+// Wait for our turn to make a call, or until ctx is done
+func (rl *rateLimiter) wait(ctx context.Context) error {
+	if rl.interval == 0 {
+		return ctx.Err()
+	}
+
+	rl.mu.Lock()
+	now := time.Now()
+	at := rl.next
+	if at.Before(now) {
+		at = now
+	}
+	rl.next = at.Add(rl.interval)
+	rl.mu.Unlock()
+
+	timer := time.NewTimer(at.Sub(now))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
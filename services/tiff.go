@@ -0,0 +1,65 @@
+package services
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+var errTruncatedTIFF = errors.New("tiff: truncated")
+
+// The most pages a TIFF can be asked for; scans and faxes run to hundreds at most
+const MaxTIFFPages = 10000
+
+// Get a TIFF whose first page is the given page (from 1) of the original. The TIFF decoder only
+// ever decodes the first image file directory (IFD) in a file, so we follow the chain of them to
+// the page's, and point the header at that one instead; the rest of the file is left as it is, as
+// the IFD refers to its image data by offset. ErrPageNotFound if there aren't that many pages, or
+// the chain loops back on itself before getting there
+func tiffPage(data []byte, page int) ([]byte, error) {
+	if page <= 1 {
+		return data, nil
+	}
+	if page > MaxTIFFPages {
+		return nil, ErrPageNotFound
+	}
+	if len(data) < 8 {
+		return nil, errTruncatedTIFF
+	}
+
+	var order binary.ByteOrder
+	switch string(data[0:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return nil, errors.New("tiff: not a tiff")
+	}
+
+	offset := order.Uint32(data[4:8])
+	visited := make(map[uint32]bool)
+	for i := 1; i < page; i++ {
+		if visited[offset] {
+			return nil, ErrPageNotFound
+		}
+		visited[offset] = true
+
+		// the IFD's entry count, its 12 byte entries, and then the offset of the next IFD
+		pos := int64(offset)
+		if pos+2 > int64(len(data)) {
+			return nil, errTruncatedTIFF
+		}
+		next := pos + 2 + 12*int64(order.Uint16(data[pos:pos+2]))
+		if next+4 > int64(len(data)) {
+			return nil, errTruncatedTIFF
+		}
+		if offset = order.Uint32(data[next : next+4]); offset == 0 {
+			return nil, ErrPageNotFound
+		}
+	}
+
+	paged := make([]byte, len(data))
+	copy(paged, data)
+	order.PutUint32(paged[4:8], offset)
+	return paged, nil
+}
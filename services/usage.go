@@ -0,0 +1,263 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"path"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/telepedia/thumbra/models"
+)
+
+// How much storage one wiki's thumbnails take up
+type WikiUsage struct {
+	Wiki    string `json:"wiki"`
+	Bytes   int64  `json:"bytes"`
+	Objects int64  `json:"objects"`
+	// how many different widths the wiki has thumbnails at
+	Widths int `json:"widths"`
+	// in bytes; left out if the wiki has no quota
+	Quota int64 `json:"quota,omitempty"`
+	// when the thumbnails were last listed; left out if they haven't been, in which case
+	// the counts only cover what this instance has done since it started
+	Scanned *time.Time `json:"scanned,omitempty"`
+}
+
+// Running totals of each wiki's thumbnails. These are kept up to date as thumbnails are uploaded
+// and removed, and corrected by listing them (ScanUsage) every so often, since other instances
+// (and MediaWiki) write to the same storage, and replacing a thumbnail counts it twice
+type usageCounters struct {
+	mu    sync.Mutex
+	wikis map[string]*wikiCounters
+}
+
+type wikiCounters struct {
+	bytes   int64
+	objects int64
+	// how many thumbnails there are at each width
+	widths  map[string]int64
+	scanned time.Time
+}
+
+func newUsageCounters() *usageCounters {
+	return &usageCounters{wikis: make(map[string]*wikiCounters)}
+}
+
+// Add (or with negative numbers, take away) thumbnails of a width
+func (uc *usageCounters) add(wiki, width string, bytes, objects int64) {
+	uc.mu.Lock()
+	defer uc.mu.Unlock()
+
+	wc := uc.wikis[wiki]
+	if wc == nil {
+		wc = &wikiCounters{widths: make(map[string]int64)}
+		uc.wikis[wiki] = wc
+	}
+	wc.bytes = max(wc.bytes+bytes, 0)
+	wc.objects = max(wc.objects+objects, 0)
+	if width != "" {
+		if wc.widths[width] += objects; wc.widths[width] <= 0 {
+			delete(wc.widths, width)
+		}
+	}
+}
+
+// Replace a wiki's counters with what a scan found
+func (uc *usageCounters) set(wiki string, wc *wikiCounters) {
+	uc.mu.Lock()
+	defer uc.mu.Unlock()
+
+	uc.wikis[wiki] = wc
+}
+
+func (uc *usageCounters) bytes(wiki string) int64 {
+	uc.mu.Lock()
+	defer uc.mu.Unlock()
+
+	if wc := uc.wikis[wiki]; wc != nil {
+		return wc.bytes
+	}
+	return 0
+}
+
+func (uc *usageCounters) get(wiki string) WikiUsage {
+	uc.mu.Lock()
+	defer uc.mu.Unlock()
+
+	usage := WikiUsage{Wiki: wiki}
+	if wc := uc.wikis[wiki]; wc != nil {
+		usage.Bytes = wc.bytes
+		usage.Objects = wc.objects
+		usage.Widths = len(wc.widths)
+		if !wc.scanned.IsZero() {
+			scanned := wc.scanned
+			usage.Scanned = &scanned
+		}
+	}
+	return usage
+}
+
+func (uc *usageCounters) names() []string {
+	uc.mu.Lock()
+	defer uc.mu.Unlock()
+
+	names := make([]string, 0, len(uc.wikis))
+	for wiki := range uc.wikis {
+		names = append(names, wiki)
+	}
+	return names
+}
+
+// Get the usage of every wiki we know of, the biggest first
+func (is *ImageService) Usage() []WikiUsage {
+	wikis := is.usageWikis()
+	usage := make([]WikiUsage, 0, len(wikis))
+	for _, wiki := range wikis {
+		wu := is.usage.get(wiki)
+		wu.Quota = is.cfg.ThumbnailQuota(wiki)
+		usage = append(usage, wu)
+	}
+
+	sort.SliceStable(usage, func(i, j int) bool {
+		return usage[i].Bytes > usage[j].Bytes
+	})
+	return usage
+}
+
+// The wikis in the config, and any we have counted thumbnails for
+func (is *ImageService) usageWikis() []string {
+	wikis := slices.Clone(is.cfg.Usage.Wikis)
+	for wiki := range is.cfg.Wikis {
+		wikis = append(wikis, wiki)
+	}
+	wikis = append(wikis, is.usage.names()...)
+
+	slices.Sort(wikis)
+	return slices.Compact(wikis)
+}
+
+// Whether a wiki has used up its thumbnail quota, so no new sizes should be generated for it
+func (is *ImageService) OverQuota(wiki string) bool {
+	quota := is.cfg.ThumbnailQuota(wiki)
+	return quota > 0 && is.usage.bytes(wiki) >= quota
+}
+
+// List all of a wiki's thumbnails, and replace its counters with what is actually there. The
+// listing is spaced out by the [sweeper] rate, the same as a sweep
+func (is *ImageService) ScanUsage(ctx context.Context, wiki string) (WikiUsage, error) {
+	scan := &wikiCounters{widths: make(map[string]int64)}
+
+	cursor := ""
+	for {
+		page, err := is.sweepList(ctx, wiki+"/thumb/", cursor, sweepPageSize)
+		if err != nil {
+			return WikiUsage{}, fmt.Errorf("failed to list thumbnails: %w", err)
+		}
+		for _, obj := range page.Objects {
+			scan.bytes += obj.Size
+			scan.objects++
+			if width := thumbnailWidth(obj.Key); width != "" {
+				scan.widths[width]++
+			}
+		}
+		if cursor = page.NextCursor; cursor == "" {
+			break
+		}
+	}
+
+	scan.scanned = time.Now().UTC().Truncate(time.Second)
+	is.usage.set(wiki, scan)
+	return is.usage.get(wiki), nil
+}
+
+// Scan every wiki we know of, then wait for the interval and do it again, until ctx is done
+func (is *ImageService) RunUsageScanner(ctx context.Context) {
+	interval := time.Duration(is.cfg.Usage.ScanInterval) * time.Hour
+
+	for {
+		for _, wiki := range is.usageWikis() {
+			usage, err := is.ScanUsage(ctx, wiki)
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				log.Printf("Failed to count the thumbnails of %s: %v", wiki, err)
+				continue
+			}
+			log.Printf("%s has %d thumbnails (%d bytes) at %d widths", wiki, usage.Objects, usage.Bytes, usage.Widths)
+		}
+
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Find the width of the existing thumbnail of the same file (and format) that is nearest to the
+// one requested, for wikis over their quota; the larger one wins a tie. ErrImageNotFound if the
+// file has no thumbnails in the format
+func (is *ImageService) NearestThumbnail(ctx context.Context, req models.ThumbnailRequest) (string, error) {
+	ctx, cancel := is.stageContext(ctx, is.cfg.Timeouts.Head)
+	defer cancel()
+
+	original := req.ImageRequest()
+	prefix := original.GetThumbPrefix()
+	if req.Revision != "latest" {
+		prefix = original.GetThumbArchivePrefix()
+	}
+	objects, err := is.listObjects(ctx, prefix, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to list thumbnails: %w", err)
+	}
+
+	requested, _ := strconv.Atoi(req.Width)
+	best, bestWidth, bestDiff := "", 0, 0
+	for _, obj := range objects {
+		candidate := req
+		candidate.Width = thumbnailWidth(obj.Key)
+		// only the thumbnails in the same format as the one requested
+		if candidate.Width == "" || is.s3KeyForThumbnail(candidate) != obj.Key {
+			continue
+		}
+
+		width, _ := strconv.Atoi(candidate.Width)
+		diff := width - requested
+		if diff < 0 {
+			diff = -diff
+		}
+		if best == "" || diff < bestDiff || (diff == bestDiff && width > bestWidth) {
+			best, bestWidth, bestDiff = candidate.Width, width, diff
+		}
+	}
+
+	if best == "" {
+		return "", ErrImageNotFound
+	}
+	return best, nil
+}
+
+// Get the width of a thumbnail from its name ({width}px-{filename}), or empty if it isn't named like one
+func thumbnailWidth(key string) string {
+	name := path.Base(key)
+	end := strings.Index(name, "px-")
+	if end <= 0 {
+		return ""
+	}
+
+	start := end
+	for start > 0 && name[start-1] >= '0' && name[start-1] <= '9' {
+		start--
+	}
+	if start == end || (start > 0 && name[start-1] != '-') {
+		return ""
+	}
+	return name[start:end]
+}
@@ -0,0 +1,198 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/draw"
+	"io"
+	"time"
+
+	"github.com/HugoSmits86/nativewebp"
+)
+
+// The parts of an animated WebP we need to draw it: its canvas, and each frame's place on it,
+// timing and bitstream, which isn't decoded until the frame is drawn. The WebP decoder we use
+// doesn't understand animations at all, so the container is read here
+type webpAnimation struct {
+	width, height int
+	// how many times it plays; 0 for forever
+	loopCount int
+	frames    []webpFrame
+}
+
+type webpFrame struct {
+	bounds   image.Rectangle
+	duration time.Duration
+	// clear the frame's area of the canvas once it has been shown
+	dispose bool
+	// draw the frame over the canvas, rather than replacing what is under it
+	blend bool
+	// the frame's chunks: an ALPH chunk and a VP8 chunk, or a VP8L chunk
+	data []byte
+}
+
+// Read the container of a WebP, returning nil if it isn't animated
+func parseWebP(data []byte) (*webpAnimation, error) {
+	if len(data) < 12 || string(data[0:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return nil, fmt.Errorf("webp: not a webp")
+	}
+
+	var wa *webpAnimation
+	for pos := 12; pos < len(data); {
+		id, payload, next, err := webpChunk(data, pos)
+		if err != nil {
+			return nil, err
+		}
+		pos = next
+
+		switch id {
+		case "VP8X":
+			// the animation flag, then the canvas size; the VP8X chunk is always the first
+			if len(payload) < 10 {
+				return nil, errTruncatedWebP
+			}
+			if payload[0]&0x02 == 0 {
+				return nil, nil
+			}
+			wa = &webpAnimation{
+				width:  int(uint24(payload[4:7])) + 1,
+				height: int(uint24(payload[7:10])) + 1,
+			}
+		case "ANIM":
+			if wa == nil || len(payload) < 6 {
+				return nil, errTruncatedWebP
+			}
+			// the background colour is only a hint, and browsers clear to transparent instead
+			wa.loopCount = int(binary.LittleEndian.Uint16(payload[4:6]))
+		case "ANMF":
+			if wa == nil || len(payload) < 16 {
+				return nil, errTruncatedWebP
+			}
+			x, y := 2*int(uint24(payload[0:3])), 2*int(uint24(payload[3:6]))
+			bounds := image.Rect(x, y, x+int(uint24(payload[6:9]))+1, y+int(uint24(payload[9:12]))+1)
+			if !bounds.In(image.Rect(0, 0, wa.width, wa.height)) {
+				return nil, fmt.Errorf("webp: frame outside of the canvas")
+			}
+			wa.frames = append(wa.frames, webpFrame{
+				bounds:   bounds,
+				duration: time.Duration(uint24(payload[12:15])) * time.Millisecond,
+				dispose:  payload[15]&0x01 != 0,
+				blend:    payload[15]&0x02 == 0,
+				data:     payload[16:],
+			})
+		case "VP8 ", "VP8L":
+			// a still image
+			if wa == nil {
+				return nil, nil
+			}
+		}
+	}
+
+	if wa != nil && len(wa.frames) == 0 {
+		return nil, fmt.Errorf("webp: animation without any frames")
+	}
+	return wa, nil
+}
+
+// Read the chunk at pos, returning its id, its payload, and where the next chunk starts
+func webpChunk(data []byte, pos int) (id string, payload []byte, next int, err error) {
+	if pos+8 > len(data) {
+		return "", nil, 0, errTruncatedWebP
+	}
+	size := int(binary.LittleEndian.Uint32(data[pos+4 : pos+8]))
+	start := pos + 8
+	if size < 0 || size > len(data)-start {
+		return "", nil, 0, errTruncatedWebP
+	}
+	// chunks are padded to an even length
+	return string(data[pos : pos+4]), data[start : start+size], start + size + size&1, nil
+}
+
+func uint24(b []byte) uint32 {
+	return uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16
+}
+
+// Decode a frame's bitstream, by wrapping its chunks up as a WebP of its own
+func (f webpFrame) decode() (image.Image, error) {
+	var body bytes.Buffer
+	body.WriteString("WEBP")
+
+	// a lossy frame's alpha is in an ALPH chunk, which is only allowed after a VP8X chunk
+	if len(f.data) >= 4 && string(f.data[0:4]) == "ALPH" {
+		w, h := uint32(f.bounds.Dx()-1), uint32(f.bounds.Dy()-1)
+		body.WriteString("VP8X")
+		_ = binary.Write(&body, binary.LittleEndian, uint32(10))
+		body.Write([]byte{0x10, 0, 0, 0, byte(w), byte(w >> 8), byte(w >> 16), byte(h), byte(h >> 8), byte(h >> 16)})
+	}
+	body.Write(f.data)
+
+	var file bytes.Buffer
+	file.WriteString("RIFF")
+	_ = binary.Write(&file, binary.LittleEndian, uint32(body.Len()))
+	file.Write(body.Bytes())
+
+	return nativewebp.Decode(&file)
+}
+
+// Draw the frames of an animated WebP. Before each frame, the area of the one before it is cleared
+// if that one asked to be disposed of, and then the frame is either blended over the canvas or
+// replaces what is there, as it says
+func (wa *webpAnimation) animation() *animation {
+	return &animation{
+		plays: wa.loopCount,
+		render: func(ctx context.Context, fn func(frame animationFrame) error) error {
+			canvas := image.NewRGBA(image.Rect(0, 0, wa.width, wa.height))
+
+			for i, frame := range wa.frames {
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+				if i > 0 && wa.frames[i-1].dispose {
+					prev := wa.frames[i-1].bounds
+					draw.Draw(canvas, prev, image.Transparent, image.Point{}, draw.Src)
+				}
+
+				img, err := frame.decode()
+				if err != nil {
+					return fmt.Errorf("failed to decode frame %d: %w", i, err)
+				}
+				op := draw.Src
+				if frame.blend {
+					op = draw.Over
+				}
+				draw.Draw(canvas, frame.bounds, img, img.Bounds().Min, op)
+
+				if err := fn(animationFrame{image: canvas, delay: frame.duration}); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	}
+}
+
+// Decode a WebP, or the first frame of an animated one
+func decodeWebP(r io.Reader) (image.Image, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	wa, err := parseWebP(data)
+	if err != nil || wa == nil {
+		return nativewebp.Decode(bytes.NewReader(data))
+	}
+
+	var first image.Image
+	err = wa.animation().render(context.Background(), func(frame animationFrame) error {
+		first = frame.image
+		return errStopRender
+	})
+	if err != errStopRender {
+		return nil, err
+	}
+	return first, nil
+}
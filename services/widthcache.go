@@ -0,0 +1,67 @@
+package services
+
+import (
+	"container/list"
+	"sync"
+)
+
+// how many originals we remember the width of
+const widthCacheSize = 10000
+
+// A small LRU cache of the widths of originals we have decoded, so that a request
+// for a thumbnail wider than its original can be answered without downloading and
+// decoding the original again. Entries are keyed by S3 key, and only trusted if the
+// ETag still matches, so a re-uploaded original is picked up straight away
+type widthCache struct {
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List
+}
+
+type widthCacheEntry struct {
+	key   string
+	etag  string
+	width int
+}
+
+func newWidthCache() *widthCache {
+	return &widthCache{
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// Get the entry for an original, regardless of its ETag; the caller checks the ETag
+func (c *widthCache) get(key string) (widthCacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[key]
+	if !ok {
+		return widthCacheEntry{}, false
+	}
+	c.order.MoveToFront(el)
+	return *el.Value.(*widthCacheEntry), true
+}
+
+// Remember the width of an original, evicting the least recently used entry if we are full
+func (c *widthCache) add(key, etag string, width int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[key]; ok {
+		entry := el.Value.(*widthCacheEntry)
+		entry.etag = etag
+		entry.width = width
+		c.order.MoveToFront(el)
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(&widthCacheEntry{key: key, etag: etag, width: width})
+
+	if c.order.Len() > widthCacheSize {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*widthCacheEntry).key)
+	}
+}
@@ -0,0 +1,125 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/telepedia/thumbra/config"
+	"github.com/telepedia/thumbra/models"
+)
+
+var (
+	// returned by every backend when the key doesn't exist, whatever the
+	// underlying store calls it
+	ErrObjectNotFound = fmt.Errorf("object not found")
+	// returned when a requested range starts beyond the end of the object
+	ErrInvalidRange = fmt.Errorf("requested range is not satisfiable")
+	// returned without trying while a backend's circuit breaker is open, since it has been
+	// failing and we are giving it a rest
+	ErrBackendUnavailable = fmt.Errorf("backend unavailable")
+)
+
+// A store that originals and thumbnails are read from and thumbnails are written to.
+// Keys are the paths built by models.ImageRequest and models.ThumbnailRequest, ie
+// {wiki}/{hash1}/{hash2}/{filename}
+type Backend interface {
+	// Get an object, or only the range br of it if not nil. The body is streamed
+	// from the store, and the caller must close it
+	Get(ctx context.Context, key string, br *models.ByteRange) (*models.ImageResponse, error)
+	// Get the metadata about an object without its body
+	Head(ctx context.Context, key string) (*models.ImageResponse, error)
+	// Store an object, replacing it if it already exists
+	Put(ctx context.Context, key string, data []byte, opts PutOptions) error
+	// Delete an object; deleting an object that doesn't exist is not an error
+	Delete(ctx context.Context, key string) error
+	// List the objects under a prefix in key order, a page at a time. Pass the NextCursor
+	// of the previous page to get the next one, or an empty cursor to start from the beginning
+	List(ctx context.Context, prefix, cursor string, limit int) (*ListPage, error)
+}
+
+// Options for storing an object
+type PutOptions struct {
+	ContentType string
+	// user metadata to store with the object. Keys should be lower case, as some stores
+	// don't keep the case; the filesystem backend doesn't store metadata at all
+	Metadata map[string]string
+}
+
+// An object returned from a listing. ETag is empty if the backend can't get it without
+// reading the object
+type ObjectInfo struct {
+	Key          string
+	Size         int64
+	ETag         string
+	LastModified time.Time
+}
+
+// A page of a listing. NextCursor is empty once there is nothing left to list; it is the
+// last key on the page, so a listing can be resumed later (or against another backend)
+type ListPage struct {
+	Objects    []ObjectInfo
+	NextCursor string
+}
+
+// Create the backends chosen in the [storage] config: the one originals are read from, and
+// the one thumbnails are kept in. These are the same backend unless thumbnails have been
+// given their own bucket or settings in S3. With a replica, each is replicated to its
+// counterpart in the replica. Every backend is wrapped in the retries and circuit breaker
+// from the [resilience] config, underneath the replication so that reads fail over to
+// the replica as soon as the primary's breaker opens
+func NewBackends(cfg *config.Config) (originals Backend, thumbnails Backend, err error) {
+	originals, thumbnails, err = newBackends(cfg.Storage.Backend, cfg.S3, cfg.Swift, cfg.Filesystem, newGuard(cfg.Resilience), "")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	replica := cfg.Storage.Replica
+	if replica.Backend == "" {
+		return originals, thumbnails, nil
+	}
+
+	replicaOriginals, replicaThumbnails, err := newBackends(replica.Backend, replica.S3, replica.Swift, replica.Filesystem, newGuard(cfg.Resilience), "replica ")
+	if err != nil {
+		return nil, nil, fmt.Errorf("replica: %w", err)
+	}
+
+	latency := time.Duration(replica.FailoverLatency) * time.Millisecond
+	replicatedOriginals := NewReplicated(originals, replicaOriginals, latency)
+	if originals == thumbnails && replicaOriginals == replicaThumbnails {
+		return replicatedOriginals, replicatedOriginals, nil
+	}
+	return replicatedOriginals, NewReplicated(thumbnails, replicaThumbnails, latency), nil
+}
+
+// Create a pair of backends, guarded by g. The label goes in front of their names in the
+// log, so that the primary and the replica can be told apart
+func newBackends(backend string, s3 config.S3Config, swift config.SwiftConfig, fs config.FilesystemConfig, g *guard, label string) (Backend, Backend, error) {
+	switch backend {
+	case config.BackendS3:
+		s3Client, err := New(s3)
+		if err != nil {
+			return nil, nil, err
+		}
+		thumbs, err := s3Client.Thumbnails(s3.Thumbnails)
+		if err != nil {
+			return nil, nil, err
+		}
+		return g.wrap(label+"s3 bucket "+s3Client.Bucket, s3Client), g.wrap(label+"s3 bucket "+thumbs.Bucket, thumbs), nil
+	case config.BackendMemory:
+		memory := g.wrap(label+"memory", NewMemory())
+		return memory, memory, nil
+	case config.BackendFilesystem:
+		filesystem, err := NewFilesystem(fs)
+		if err != nil {
+			return nil, nil, err
+		}
+		guarded := g.wrap(label+"filesystem", filesystem)
+		return guarded, guarded, nil
+	case config.BackendSwift:
+		swiftClient := g.wrap(label+"swift", NewSwift(swift))
+		return swiftClient, swiftClient, nil
+	default:
+		return nil, nil, fmt.Errorf("unknown storage backend %q", backend)
+	}
+}
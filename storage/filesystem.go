@@ -0,0 +1,372 @@
+package storage
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/telepedia/thumbra/config"
+	"github.com/telepedia/thumbra/models"
+)
+
+// replaced with the wiki name in the root, for farms where every wiki has its own upload directory
+const wikiPlaceholder = "{wiki}"
+
+// files we are still writing are hidden (and so left out of listings) until they are renamed into place
+const tempFilePrefix = ".thumbra-"
+
+// how deep a listing will go; MediaWiki's layout is never more than a few directories deep
+// (wiki/thumb/archive/a/a0/file/thumb), and this stops a symlink loop from going on forever
+const maxListDepth = 10
+
+// A backend that keeps files on local disk, laid out the same way as MediaWiki's $wgUploadDirectory
+// (a/a0/Foo.png, archive/a/a0/..., thumb/a/a0/Foo.png/...), so a wiki's existing images directory
+// can be served as it is. The filesystem has nowhere to keep metadata, so the content type comes
+// from the file extension, Last-Modified from the mtime and the ETag from an MD5 of the contents
+// (the same as S3 gives for a normal upload, so ETags don't change when moving between the two).
+// User metadata passed to Put is dropped
+type Filesystem struct {
+	root string
+	// the only wiki, whose files are directly in the root; empty if each wiki has a directory
+	wiki   string
+	hashes *hashCache
+}
+
+func NewFilesystem(cfg config.FilesystemConfig) (*Filesystem, error) {
+	if cfg.Root == "" {
+		return nil, fmt.Errorf("filesystem root is not set")
+	}
+
+	root, err := filepath.Abs(cfg.Root)
+	if err != nil {
+		return nil, err
+	}
+
+	// with a placeholder, each wiki's directory is only looked at when it is used
+	if !strings.Contains(root, wikiPlaceholder) {
+		info, err := os.Stat(root)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			return nil, fmt.Errorf("filesystem root %s is not a directory", root)
+		}
+	}
+
+	return &Filesystem{root: root, wiki: cfg.Wiki, hashes: newHashCache()}, nil
+}
+
+func (f *Filesystem) Get(ctx context.Context, key string, br *models.ByteRange) (*models.ImageResponse, error) {
+	file, resp, err := f.open(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if br == nil {
+		resp.Body = file
+		return resp, nil
+	}
+
+	size := resp.Length
+	if br.Start >= size {
+		file.Close()
+		return nil, ErrInvalidRange
+	}
+	if _, err := file.Seek(br.Start, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	part := &models.ByteRange{Start: br.Start, Length: min(br.Length, size-br.Start)}
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(file, part.Length), file}
+	resp.Length = part.Length
+	resp.ContentRange = part.ContentRange(size)
+
+	return resp, nil
+}
+
+func (f *Filesystem) Head(ctx context.Context, key string) (*models.ImageResponse, error) {
+	file, resp, err := f.open(key)
+	if err != nil {
+		return nil, err
+	}
+	file.Close()
+	return resp, nil
+}
+
+// Write the file to a temporary file next to it and rename it into place, so that readers
+// (including MediaWiki) only ever see the old file or the whole of the new one
+func (f *Filesystem) Put(ctx context.Context, key string, data []byte, opts PutOptions) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	p, err := f.path(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(p), tempFilePrefix+"*")
+	if err != nil {
+		return err
+	}
+	// does nothing once the file has been renamed
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	// CreateTemp only lets us read it, but the web server may be serving these directly
+	if err := os.Chmod(tmp.Name(), 0o644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), p); err != nil {
+		return err
+	}
+
+	// we already know the hash, so save hashing it again when it's first requested
+	if info, err := os.Stat(p); err == nil {
+		f.hashes.add(p, info.Size(), info.ModTime(), md5ETag(data))
+	}
+
+	return nil
+}
+
+func (f *Filesystem) Delete(ctx context.Context, key string) error {
+	p, err := f.path(key)
+	if err != nil {
+		return err
+	}
+
+	f.hashes.remove(p)
+	if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// List the files under a prefix. Directories are walked in key order rather than name order (a
+// directory "Foo" sorts as "Foo/", which comes after "Foo.png"), so we can stop as soon as the
+// page is full. Hidden files are skipped, as are ETags for files we haven't already hashed
+func (f *Filesystem) List(ctx context.Context, prefix, cursor string, limit int) (*ListPage, error) {
+	dirKey := prefix[:strings.LastIndex(prefix, "/")+1]
+	if dirKey == "" && strings.Contains(f.root, wikiPlaceholder) {
+		return nil, fmt.Errorf("cannot list across wikis when each wiki has its own root")
+	}
+
+	page := &ListPage{}
+	dir := f.root
+	if dirKey == "" && f.wiki != "" {
+		// the root holds the one wiki's files, rather than a directory for each wiki
+		dirKey = f.wiki + "/"
+	} else if dirKey != "" {
+		var err error
+		if dir, err = f.path(strings.TrimSuffix(dirKey, "/")); err != nil {
+			return page, nil
+		}
+	}
+
+	_, err := f.walkDir(ctx, dir, dirKey, prefix, cursor, 0, func(key string, info fs.FileInfo) bool {
+		if limit > 0 && len(page.Objects) == limit {
+			page.NextCursor = page.Objects[len(page.Objects)-1].Key
+			return false
+		}
+
+		obj := ObjectInfo{
+			Key:          key,
+			Size:         info.Size(),
+			LastModified: info.ModTime().UTC().Truncate(time.Second),
+		}
+		if p, err := f.path(key); err == nil {
+			obj.ETag, _ = f.hashes.get(p, info.Size(), info.ModTime())
+		}
+		page.Objects = append(page.Objects, obj)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return page, nil
+}
+
+// Walk a directory (whose key is dirKey) depth first in key order, calling fn for every file
+// matching the prefix after the cursor until it returns false. Returns false if fn did
+func (f *Filesystem) walkDir(ctx context.Context, dir, dirKey, prefix, cursor string, depth int, fn func(string, fs.FileInfo) bool) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	if depth > maxListDepth {
+		return true, nil
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		// the directory not existing (yet, or any more) just means there is nothing in it
+		if errors.Is(err, fs.ErrNotExist) || errors.Is(err, syscall.ENOTDIR) {
+			return true, nil
+		}
+		return false, err
+	}
+
+	type entry struct {
+		key  string
+		info fs.FileInfo
+	}
+	children := make([]entry, 0, len(entries))
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		// Stat rather than e.Info so that symlinks are followed
+		info, err := os.Stat(filepath.Join(dir, e.Name()))
+		if err != nil {
+			continue
+		}
+		key := dirKey + e.Name()
+		if info.IsDir() {
+			key += "/"
+		} else if !info.Mode().IsRegular() {
+			continue
+		}
+		children = append(children, entry{key: key, info: info})
+	}
+	sort.Slice(children, func(i, j int) bool { return children[i].key < children[j].key })
+
+	for _, child := range children {
+		if !child.info.IsDir() {
+			if strings.HasPrefix(child.key, prefix) && child.key > cursor && !fn(child.key, child.info) {
+				return false, nil
+			}
+			continue
+		}
+
+		// skip directories that can't hold anything under the prefix, or only hold keys before the cursor
+		if !strings.HasPrefix(child.key, prefix) && !strings.HasPrefix(prefix, child.key) {
+			continue
+		}
+		if cursor > child.key && !strings.HasPrefix(cursor, child.key) {
+			continue
+		}
+
+		more, err := f.walkDir(ctx, filepath.Join(dir, child.info.Name()), child.key, prefix, cursor, depth+1, fn)
+		if err != nil || !more {
+			return more, err
+		}
+	}
+
+	return true, nil
+}
+
+// Open a file and describe it, making sure the description matches what was opened (even if the
+// file is replaced while we are looking at it)
+func (f *Filesystem) open(key string) (*os.File, *models.ImageResponse, error) {
+	p, err := f.path(key)
+	if err != nil {
+		// a key that would escape the root can't exist in it
+		return nil, nil, ErrObjectNotFound
+	}
+
+	file, err := os.Open(p)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) || errors.Is(err, syscall.ENOTDIR) {
+			return nil, nil, ErrObjectNotFound
+		}
+		return nil, nil, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	if !info.Mode().IsRegular() {
+		file.Close()
+		return nil, nil, ErrObjectNotFound
+	}
+
+	etag, ok := f.hashes.get(p, info.Size(), info.ModTime())
+	if !ok {
+		hash := md5.New()
+		if _, err := io.Copy(hash, file); err != nil {
+			file.Close()
+			return nil, nil, err
+		}
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			file.Close()
+			return nil, nil, err
+		}
+		etag = `"` + hex.EncodeToString(hash.Sum(nil)) + `"`
+		f.hashes.add(p, info.Size(), info.ModTime(), etag)
+	}
+
+	contentType := mime.TypeByExtension(path.Ext(key))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	return file, &models.ImageResponse{
+		ContentType:  contentType,
+		Length:       info.Size(),
+		ETag:         etag,
+		LastModified: info.ModTime().UTC().Truncate(time.Second),
+	}, nil
+}
+
+// Map a key onto a path under the root. Every part of the key must be a plain file or directory
+// name, so nothing (.., an absolute path, an empty part) can take the path outside the root. The
+// key's first part is the wiki, which either fills in the root's placeholder, is a directory
+// under the root, or (for a single wiki) must be that wiki, whose files are in the root.
+// Symlinks inside the root are followed, since they were put there by whoever runs the wiki
+func (f *Filesystem) path(key string) (string, error) {
+	parts := strings.Split(key, "/")
+	for _, part := range parts {
+		if part == "." || !filepath.IsLocal(part) || strings.ContainsRune(part, filepath.Separator) {
+			return "", fmt.Errorf("invalid key %q", key)
+		}
+	}
+
+	if f.wiki != "" {
+		if parts[0] != f.wiki {
+			return "", fmt.Errorf("key %q isn't in wiki %s", key, f.wiki)
+		}
+		return filepath.Join(append([]string{f.root}, parts[1:]...)...), nil
+	}
+	if strings.Contains(f.root, wikiPlaceholder) {
+		root := strings.ReplaceAll(f.root, wikiPlaceholder, parts[0])
+		return filepath.Join(append([]string{root}, parts[1:]...)...), nil
+	}
+	return filepath.Join(append([]string{f.root}, parts...)...), nil
+}
+
+func md5ETag(data []byte) string {
+	sum := md5.Sum(data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
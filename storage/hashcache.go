@@ -0,0 +1,80 @@
+package storage
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// how many files we remember the ETag of
+const hashCacheSize = 10000
+
+// A small LRU cache of the ETags of files on disk, so that we don't hash the whole file
+// on every request. An entry is only trusted while the file's size and mtime still match,
+// so a file that has been replaced (by us or by MediaWiki) is hashed again
+type hashCache struct {
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List
+}
+
+type hashCacheEntry struct {
+	path    string
+	size    int64
+	modTime time.Time
+	etag    string
+}
+
+func newHashCache() *hashCache {
+	return &hashCache{
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// Get the ETag of a file, if we have one for this version of it
+func (c *hashCache) get(path string, size int64, modTime time.Time) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[path]
+	if !ok {
+		return "", false
+	}
+	entry := el.Value.(*hashCacheEntry)
+	if entry.size != size || !entry.modTime.Equal(modTime) {
+		return "", false
+	}
+	c.order.MoveToFront(el)
+	return entry.etag, true
+}
+
+// Remember the ETag of a file, evicting the least recently used entry if we are full
+func (c *hashCache) add(path string, size int64, modTime time.Time, etag string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[path]; ok {
+		*el.Value.(*hashCacheEntry) = hashCacheEntry{path: path, size: size, modTime: modTime, etag: etag}
+		c.order.MoveToFront(el)
+		return
+	}
+
+	c.entries[path] = c.order.PushFront(&hashCacheEntry{path: path, size: size, modTime: modTime, etag: etag})
+
+	if c.order.Len() > hashCacheSize {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*hashCacheEntry).path)
+	}
+}
+
+func (c *hashCache) remove(path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[path]; ok {
+		c.order.Remove(el)
+		delete(c.entries, path)
+	}
+}
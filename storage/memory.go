@@ -0,0 +1,144 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"maps"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/telepedia/thumbra/models"
+)
+
+// A backend that keeps everything in memory. Nothing survives a restart, so this is for
+// running Thumbra without any real storage (ie in development) and for tests
+type Memory struct {
+	mu      sync.RWMutex
+	objects map[string]memoryObject
+}
+
+type memoryObject struct {
+	data         []byte
+	contentType  string
+	etag         string
+	lastModified time.Time
+	metadata     map[string]string
+}
+
+func NewMemory() *Memory {
+	return &Memory{objects: make(map[string]memoryObject)}
+}
+
+func (m *Memory) Get(ctx context.Context, key string, br *models.ByteRange) (*models.ImageResponse, error) {
+	obj, err := m.lookup(key)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := obj.response()
+	data := obj.data
+	if br != nil {
+		if br.Start >= int64(len(data)) {
+			return nil, ErrInvalidRange
+		}
+		end := min(br.Start+br.Length, int64(len(data)))
+		resp.ContentRange = (&models.ByteRange{Start: br.Start, Length: end - br.Start}).ContentRange(int64(len(data)))
+		data = data[br.Start:end]
+		resp.Length = int64(len(data))
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(data))
+
+	return resp, nil
+}
+
+func (m *Memory) Head(ctx context.Context, key string) (*models.ImageResponse, error) {
+	obj, err := m.lookup(key)
+	if err != nil {
+		return nil, err
+	}
+	return obj.response(), nil
+}
+
+func (m *Memory) Put(ctx context.Context, key string, data []byte, opts PutOptions) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.objects[key] = memoryObject{
+		// copy, so that the caller can't change what we have stored
+		data:         bytes.Clone(data),
+		contentType:  opts.ContentType,
+		etag:         md5ETag(data),
+		lastModified: time.Now().UTC().Truncate(time.Second),
+		metadata:     maps.Clone(opts.Metadata),
+	}
+	return nil
+}
+
+func (m *Memory) Delete(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.objects, key)
+	return nil
+}
+
+func (m *Memory) List(ctx context.Context, prefix, cursor string, limit int) (*ListPage, error) {
+	m.mu.RLock()
+	keys := make([]string, 0)
+	for key := range m.objects {
+		if strings.HasPrefix(key, prefix) && key > cursor {
+			keys = append(keys, key)
+		}
+	}
+	m.mu.RUnlock()
+
+	sort.Strings(keys)
+
+	page := &ListPage{}
+	if limit > 0 && len(keys) > limit {
+		keys = keys[:limit]
+		page.NextCursor = keys[len(keys)-1]
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, key := range keys {
+		obj, ok := m.objects[key]
+		if !ok {
+			// deleted while we were sorting
+			continue
+		}
+		page.Objects = append(page.Objects, ObjectInfo{
+			Key:          key,
+			Size:         int64(len(obj.data)),
+			ETag:         obj.etag,
+			LastModified: obj.lastModified,
+		})
+	}
+
+	return page, nil
+}
+
+func (m *Memory) lookup(key string) (memoryObject, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	obj, ok := m.objects[key]
+	if !ok {
+		return memoryObject{}, ErrObjectNotFound
+	}
+	return obj, nil
+}
+
+func (obj memoryObject) response() *models.ImageResponse {
+	return &models.ImageResponse{
+		ContentType:  obj.contentType,
+		Length:       int64(len(obj.data)),
+		ETag:         obj.etag,
+		LastModified: obj.lastModified,
+		Metadata:     maps.Clone(obj.metadata),
+	}
+}
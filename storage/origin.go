@@ -0,0 +1,111 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/telepedia/thumbra/config"
+	"github.com/telepedia/thumbra/models"
+)
+
+// A legacy upload server (ie nginx serving an old upload directory) that originals can be read
+// from while they are moved into storage. URLs are built from the same layout as our keys: the
+// key is added to the end of the configured URL, and if the URL has a {wiki} in it, that is
+// replaced with the wiki name instead of it being the first part of the path.
+// This is read only, so it isn't a Backend
+type Origin struct {
+	url    string
+	client *http.Client
+}
+
+// Create the origin from the config, or nil if there isn't one
+func NewOrigin(cfg config.OriginConfig) *Origin {
+	if cfg.URL == "" {
+		return nil
+	}
+
+	return &Origin{
+		url: strings.TrimSuffix(cfg.URL, "/"),
+		// there is no overall timeout; every request has a deadline from its context
+		client: &http.Client{},
+	}
+}
+
+func (o *Origin) Get(ctx context.Context, key string, br *models.ByteRange) (*models.ImageResponse, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, o.urlFor(key), nil)
+	if err != nil {
+		return nil, err
+	}
+	if br != nil {
+		req.Header.Set("Range", br.Header())
+	}
+
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusPartialContent:
+		// a server that ignores the range sends the whole file with a 200, which is
+		// still a valid answer, so we pass it on as one
+		obj := originResponse(resp)
+		obj.Body = resp.Body
+		return obj, nil
+	case http.StatusNotFound, http.StatusGone:
+		resp.Body.Close()
+		return nil, ErrObjectNotFound
+	case http.StatusRequestedRangeNotSatisfiable:
+		resp.Body.Close()
+		return nil, ErrInvalidRange
+	default:
+		resp.Body.Close()
+		return nil, fmt.Errorf("origin returned %s for %s", resp.Status, req.URL)
+	}
+}
+
+func (o *Origin) Head(ctx context.Context, key string) (*models.ImageResponse, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, o.urlFor(key), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return originResponse(resp), nil
+	case http.StatusNotFound, http.StatusGone:
+		return nil, ErrObjectNotFound
+	default:
+		return nil, fmt.Errorf("origin returned %s for %s", resp.Status, req.URL)
+	}
+}
+
+func (o *Origin) urlFor(key string) string {
+	if wiki, rest, ok := strings.Cut(key, "/"); ok && strings.Contains(o.url, wikiPlaceholder) {
+		return strings.ReplaceAll(o.url, wikiPlaceholder, wiki) + "/" + escapeObject(rest)
+	}
+	return o.url + "/" + escapeObject(key)
+}
+
+// Describe an object from the headers of a GET or HEAD. The length is -1 if the origin didn't send one
+func originResponse(resp *http.Response) *models.ImageResponse {
+	obj := &models.ImageResponse{
+		ContentType:        resp.Header.Get("Content-Type"),
+		Length:             resp.ContentLength,
+		ETag:               resp.Header.Get("ETag"),
+		ContentDisposition: resp.Header.Get("Content-Disposition"),
+		ContentRange:       resp.Header.Get("Content-Range"),
+	}
+	if lastModified, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		obj.LastModified = lastModified
+	}
+	return obj
+}
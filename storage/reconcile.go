@@ -0,0 +1,92 @@
+package storage
+
+import (
+	"context"
+)
+
+// how many keys to list from each backend at a time when reconciling
+const reconcilePageSize = 1000
+
+// The objects under a prefix that aren't the same in both backends of a replica
+type ReconcileReport struct {
+	Prefix        string
+	Checked       int
+	PrimaryOnly   []string
+	SecondaryOnly []string
+	// in both, but with a different size or ETag
+	Different []string
+}
+
+// Whether both backends had the same objects
+func (rr *ReconcileReport) Consistent() bool {
+	return len(rr.PrimaryOnly) == 0 && len(rr.SecondaryOnly) == 0 && len(rr.Different) == 0
+}
+
+// Compare what the two backends have under a prefix. Both are listed side by side in key order,
+// so only a page of each is held at a time. ETags are only compared when both backends list them
+// (the filesystem doesn't), and otherwise only the sizes are
+func (r *Replicated) Reconcile(ctx context.Context, prefix string) (*ReconcileReport, error) {
+	report := &ReconcileReport{Prefix: prefix}
+	primary := &listing{backend: r.primary, prefix: prefix}
+	secondary := &listing{backend: r.secondary, prefix: prefix}
+
+	for {
+		p, err := primary.peek(ctx)
+		if err != nil {
+			return nil, err
+		}
+		s, err := secondary.peek(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case p == nil && s == nil:
+			return report, nil
+		case s == nil || (p != nil && p.Key < s.Key):
+			report.PrimaryOnly = append(report.PrimaryOnly, p.Key)
+			primary.next()
+		case p == nil || s.Key < p.Key:
+			report.SecondaryOnly = append(report.SecondaryOnly, s.Key)
+			secondary.next()
+		default:
+			if p.Size != s.Size || (p.ETag != "" && s.ETag != "" && p.ETag != s.ETag) {
+				report.Different = append(report.Different, p.Key)
+			}
+			primary.next()
+			secondary.next()
+		}
+		report.Checked++
+	}
+}
+
+// Reads a listing a page at a time
+type listing struct {
+	backend Backend
+	prefix  string
+	cursor  string
+	page    []ObjectInfo
+	done    bool
+}
+
+// Get the next object in the listing, or nil at the end
+func (l *listing) peek(ctx context.Context) (*ObjectInfo, error) {
+	for len(l.page) == 0 && !l.done {
+		page, err := l.backend.List(ctx, l.prefix, l.cursor, reconcilePageSize)
+		if err != nil {
+			return nil, err
+		}
+		l.page = page.Objects
+		l.cursor = page.NextCursor
+		l.done = page.NextCursor == ""
+	}
+
+	if len(l.page) == 0 {
+		return nil, nil
+	}
+	return &l.page[0], nil
+}
+
+func (l *listing) next() {
+	l.page = l.page[1:]
+}
@@ -0,0 +1,229 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/telepedia/thumbra/models"
+)
+
+// A backend that keeps everything in two backends, ie buckets in two regions, so that an outage
+// of one doesn't take images offline. Writes go to both, and reads go to the primary, failing
+// over to the secondary when the primary fails or (if a latency is set) is too slow to answer.
+// Writes that only reached one of them are found by Reconcile
+type Replicated struct {
+	primary   Backend
+	secondary Backend
+	// how long to wait for the primary before asking the secondary too; 0 to only
+	// ask the secondary when the primary fails
+	latency time.Duration
+}
+
+// the outcome of a read from one of the backends
+type readResult struct {
+	obj       *models.ImageResponse
+	err       error
+	secondary bool
+	cancel    context.CancelFunc
+}
+
+func NewReplicated(primary, secondary Backend, latency time.Duration) *Replicated {
+	return &Replicated{primary: primary, secondary: secondary, latency: latency}
+}
+
+func (r *Replicated) Get(ctx context.Context, key string, br *models.ByteRange) (*models.ImageResponse, error) {
+	return r.read(ctx, key, func(ctx context.Context, b Backend) (*models.ImageResponse, error) {
+		return b.Get(ctx, key, br)
+	})
+}
+
+func (r *Replicated) Head(ctx context.Context, key string) (*models.ImageResponse, error) {
+	return r.read(ctx, key, func(ctx context.Context, b Backend) (*models.ImageResponse, error) {
+		return b.Head(ctx, key)
+	})
+}
+
+// Write to both backends at once. This only fails if neither write worked; if only one did,
+// the object is still available, and the other copy is left for reconciliation
+func (r *Replicated) Put(ctx context.Context, key string, data []byte, opts PutOptions) error {
+	primaryErr, secondaryErr := r.both(func(b Backend) error {
+		return b.Put(ctx, key, data, opts)
+	})
+
+	if primaryErr != nil && secondaryErr != nil {
+		return errors.Join(primaryErr, secondaryErr)
+	}
+	if primaryErr != nil {
+		log.Printf("replicated put of %s only reached the secondary: %v", key, primaryErr)
+	}
+	if secondaryErr != nil {
+		log.Printf("replicated put of %s only reached the primary: %v", key, secondaryErr)
+	}
+	return nil
+}
+
+// Delete from both backends; unlike a put, this fails if either delete did, since
+// otherwise the object would come back when reads fail over
+func (r *Replicated) Delete(ctx context.Context, key string) error {
+	primaryErr, secondaryErr := r.both(func(b Backend) error {
+		return b.Delete(ctx, key)
+	})
+	return errors.Join(primaryErr, secondaryErr)
+}
+
+// List from the primary, or the secondary if the primary fails
+func (r *Replicated) List(ctx context.Context, prefix, cursor string, limit int) (*ListPage, error) {
+	page, err := r.primary.List(ctx, prefix, cursor, limit)
+	if err == nil || ctx.Err() != nil {
+		return page, err
+	}
+
+	log.Printf("replicated list of %s failed on the primary, using the secondary: %v", prefix, err)
+	return r.secondary.List(ctx, prefix, cursor, limit)
+}
+
+// Run a write against both backends at the same time
+func (r *Replicated) both(write func(Backend) error) (primaryErr, secondaryErr error) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		primaryErr = write(r.primary)
+	}()
+	go func() {
+		defer wg.Done()
+		secondaryErr = write(r.secondary)
+	}()
+	wg.Wait()
+	return primaryErr, secondaryErr
+}
+
+// Read from the primary, also asking the secondary if the primary fails or takes longer than the
+// latency, and use the first answer. The object not existing counts as an answer, except from the
+// secondary while the primary might still have it, as the secondary may just not have caught up
+func (r *Replicated) read(ctx context.Context, key string, fn func(context.Context, Backend) (*models.ImageResponse, error)) (*models.ImageResponse, error) {
+	results := make(chan readResult, 2)
+	// so that the read we don't use can be stopped as soon as we have an answer
+	var cancels []context.CancelFunc
+	start := func(b Backend, secondary bool) {
+		ctx, cancel := context.WithCancel(ctx)
+		cancels = append(cancels, cancel)
+		go func() {
+			obj, err := fn(ctx, b)
+			results <- readResult{obj: obj, err: err, secondary: secondary, cancel: cancel}
+		}()
+	}
+
+	start(r.primary, false)
+	pending := 1
+	secondaryStarted := false
+	primaryFailed := false
+
+	var timeout <-chan time.Time
+	if r.latency > 0 {
+		timer := time.NewTimer(r.latency)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	var firstErr, secondaryMissing error
+	for pending > 0 {
+		select {
+		case <-timeout:
+			if !secondaryStarted {
+				log.Printf("primary is slow to answer for %s, asking the secondary too", key)
+				start(r.secondary, true)
+				secondaryStarted = true
+				pending++
+			}
+
+		case res := <-results:
+			pending--
+
+			answered := res.err == nil || errors.Is(res.err, ErrObjectNotFound) || errors.Is(res.err, ErrInvalidRange)
+			if answered && res.secondary && res.err != nil && !primaryFailed && pending > 0 {
+				// the primary may still have it, so wait to hear from the primary
+				secondaryMissing = res.err
+				res.cancel()
+				continue
+			}
+			if answered {
+				// the other read (if there is one) isn't needed any more
+				if pending > 0 {
+					for i, cancel := range cancels {
+						// the primary was started first
+						if (i == 1) != res.secondary {
+							cancel()
+						}
+					}
+					go discardReads(results, pending)
+				}
+				return withCancel(res), res.err
+			}
+
+			res.cancel()
+			if ctx.Err() != nil {
+				return nil, res.err
+			}
+			if firstErr == nil {
+				firstErr = res.err
+			}
+
+			if !res.secondary {
+				primaryFailed = true
+				if secondaryMissing != nil {
+					return nil, secondaryMissing
+				}
+				if !secondaryStarted {
+					log.Printf("primary failed for %s, using the secondary: %v", key, res.err)
+					start(r.secondary, true)
+					secondaryStarted = true
+					pending++
+				}
+			}
+		}
+	}
+
+	if secondaryMissing != nil {
+		return nil, secondaryMissing
+	}
+	return nil, firstErr
+}
+
+// Attach the read's context to the body of the object, so that it lasts until the body
+// is closed; anything else is finished with now
+func withCancel(res readResult) *models.ImageResponse {
+	if res.obj == nil || res.obj.Body == nil {
+		res.cancel()
+		return res.obj
+	}
+	res.obj.Body = &closeCancel{ReadCloser: res.obj.Body, cancel: res.cancel}
+	return res.obj
+}
+
+// Wait for the reads we no longer need, closing anything they opened
+func discardReads(results <-chan readResult, pending int) {
+	for range pending {
+		res := <-results
+		if res.obj != nil && res.obj.Body != nil {
+			res.obj.Body.Close()
+		}
+		res.cancel()
+	}
+}
+
+// Cancels a read's context once its body is closed
+type closeCancel struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *closeCancel) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
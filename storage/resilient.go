@@ -0,0 +1,207 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"github.com/telepedia/thumbra/config"
+	"github.com/telepedia/thumbra/models"
+)
+
+// Wraps a backend so that reads, listings and deletes that fail are retried with a jittered
+// backoff, and so that once the backend has failed too many times in a row its circuit breaker
+// opens and calls fail with ErrBackendUnavailable straight away, rather than piling more work
+// onto a backend that is struggling. Puts aren't retried here, as thumbnail uploads have their
+// own retries, but they still go through the breaker
+type Resilient struct {
+	backend Backend
+	name    string
+	// nil if the breaker is turned off
+	breaker *breaker
+	retries int
+	backoff time.Duration
+}
+
+func (r *Resilient) Get(ctx context.Context, key string, br *models.ByteRange) (obj *models.ImageResponse, err error) {
+	err = r.retry(ctx, "get of "+key, func() error {
+		obj, err = r.backend.Get(ctx, key, br)
+		return err
+	})
+	return obj, err
+}
+
+func (r *Resilient) Head(ctx context.Context, key string) (obj *models.ImageResponse, err error) {
+	err = r.retry(ctx, "head of "+key, func() error {
+		obj, err = r.backend.Head(ctx, key)
+		return err
+	})
+	return obj, err
+}
+
+func (r *Resilient) Put(ctx context.Context, key string, data []byte, opts PutOptions) error {
+	return r.call(func() error {
+		return r.backend.Put(ctx, key, data, opts)
+	})
+}
+
+func (r *Resilient) Delete(ctx context.Context, key string) error {
+	return r.retry(ctx, "delete of "+key, func() error {
+		return r.backend.Delete(ctx, key)
+	})
+}
+
+func (r *Resilient) List(ctx context.Context, prefix, cursor string, limit int) (page *ListPage, err error) {
+	err = r.retry(ctx, "list of "+prefix, func() error {
+		page, err = r.backend.List(ctx, prefix, cursor, limit)
+		return err
+	})
+	return page, err
+}
+
+// Make a call, and retry it while it fails for a reason that another try might fix. Every
+// try goes through the breaker, so we stop retrying as soon as the breaker opens
+func (r *Resilient) retry(ctx context.Context, op string, fn func() error) error {
+	for attempt := 0; ; attempt++ {
+		err := r.call(fn)
+		if !failed(err) || errors.Is(err, ErrBackendUnavailable) || attempt >= r.retries || ctx.Err() != nil {
+			return err
+		}
+
+		delay := jitter(r.backoff << attempt)
+		log.Printf("%s: %s failed (attempt %d of %d), retrying in %s: %v", r.name, op, attempt+1, r.retries+1, delay, err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
+
+// Make a single call through the breaker
+func (r *Resilient) call(fn func() error) error {
+	if r.breaker == nil {
+		return fn()
+	}
+
+	probe, ok := r.breaker.allow()
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrBackendUnavailable, r.name)
+	}
+	err := fn()
+	r.breaker.record(err, probe)
+	return err
+}
+
+// Whether an error means the backend failed, rather than it answering that the object doesn't
+// exist or the client going away
+func failed(err error) bool {
+	return err != nil &&
+		!errors.Is(err, ErrObjectNotFound) &&
+		!errors.Is(err, ErrInvalidRange) &&
+		!errors.Is(err, context.Canceled)
+}
+
+// Wait a random amount of time up to d ("full jitter"), so that retries from many requests
+// (and many instances) are spread out rather than arriving at the backend together
+func jitter(d time.Duration) time.Duration {
+	if d <= 0 {
+		return 0
+	}
+	return rand.N(d)
+}
+
+// A circuit breaker for one backend. It opens once threshold calls in a row have failed, and
+// after the cooldown lets a single call through (the probe) to see whether the backend is back:
+// if it works the breaker closes again, and if it doesn't it stays open for another cooldown
+type breaker struct {
+	name      string
+	threshold int
+	cooldown  time.Duration
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+// Whether a call may go ahead, and if so whether it is the probe
+func (b *breaker) allow() (probe bool, ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.failures < b.threshold {
+		return false, true
+	}
+	if b.probing || time.Now().Before(b.openUntil) {
+		return false, false
+	}
+	b.probing = true
+	return true, true
+}
+
+// Record how a call went
+func (b *breaker) record(err error, probe bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if probe {
+		b.probing = false
+	}
+
+	switch {
+	case errors.Is(err, context.Canceled):
+		// the client went away, which tells us nothing about the backend
+	case !failed(err):
+		if b.failures >= b.threshold {
+			log.Printf("%s is answering again, closing its circuit breaker", b.name)
+		}
+		b.failures = 0
+	default:
+		b.failures++
+		if b.failures == b.threshold || probe {
+			log.Printf("%s has failed %d times in a row, opening its circuit breaker for %s: %v", b.name, b.failures, b.cooldown, err)
+		}
+		if b.failures >= b.threshold {
+			b.openUntil = time.Now().Add(b.cooldown)
+		}
+	}
+}
+
+// Wraps backends in Resilient, sharing one breaker between the backends with the same name
+// (ie originals and thumbnails kept in the same bucket under different prefixes), since they
+// fail together
+type guard struct {
+	cfg      config.ResilienceConfig
+	breakers map[string]*breaker
+}
+
+func newGuard(cfg config.ResilienceConfig) *guard {
+	return &guard{cfg: cfg, breakers: make(map[string]*breaker)}
+}
+
+func (g *guard) wrap(name string, backend Backend) Backend {
+	r := &Resilient{
+		backend: backend,
+		name:    name,
+		retries: g.cfg.Retries,
+		backoff: time.Duration(g.cfg.RetryBackoff) * time.Millisecond,
+	}
+
+	if g.cfg.BreakerThreshold > 0 {
+		if g.breakers[name] == nil {
+			g.breakers[name] = &breaker{
+				name:      name,
+				threshold: g.cfg.BreakerThreshold,
+				cooldown:  time.Duration(g.cfg.BreakerCooldown) * time.Second,
+			}
+		}
+		r.breaker = g.breakers[name]
+	}
+
+	return r
+}
@@ -3,12 +3,24 @@ package storage
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
-	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
 	awsconfig "github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/credentials"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
 	"github.com/telepedia/thumbra/config"
 	"github.com/telepedia/thumbra/models"
 )
@@ -16,56 +28,152 @@ import (
 type S3Client struct {
 	S3     *s3.Client
 	Bucket string
+	// put in front of every key, and taken off again in listings
+	Prefix string
+
+	// copied for every upload, with the settings that apply to everything we write
+	putDefaults s3.PutObjectInput
 }
 
-var (
-	ErrObjectNotFound = fmt.Errorf("object not found")
-)
+// Create a client for the bucket. Anything wrong with the config (as far as we can tell
+// without talking to S3) is returned as an error, so that we can refuse to start
+func New(cfg config.S3Config) (*S3Client, error) {
+	httpClient, err := s3HTTPClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := []func(*awsconfig.LoadOptions) error{
+		awsconfig.WithHTTPClient(httpClient),
+	}
+	if cfg.Region != "" {
+		opts = append(opts, awsconfig.WithRegion(cfg.Region))
+	}
+	// without keys the SDK's default chain finds credentials in the environment,
+	// a profile, web identity or the instance role
+	if cfg.AccessKey != "" {
+		opts = append(opts, awsconfig.WithCredentialsProvider(
+			credentials.NewStaticCredentialsProvider(cfg.AccessKey, cfg.Secret(), ""),
+		))
+	}
+	// S3 compatible stores mostly don't understand the checksums the SDK now adds to every upload
+	if cfg.Endpoint != "" {
+		opts = append(opts, awsconfig.WithRequestChecksumCalculation(aws.RequestChecksumCalculationWhenRequired))
+	}
 
-func New(cfg config.S3Config) *S3Client {
-	awsCfg, err := awsconfig.LoadDefaultConfig(
-		context.TODO(),
-		awsconfig.WithRegion(cfg.Region),
-		awsconfig.WithCredentialsProvider(
-			credentials.NewStaticCredentialsProvider(
-				cfg.AccessKey,
-				cfg.SecretKey,
-				"",
-			),
-		),
-	)
+	awsCfg, err := awsconfig.LoadDefaultConfig(context.TODO(), opts...)
 	if err != nil {
-		panic(err)
+		return nil, fmt.Errorf("loading aws config: %w", err)
+	}
+	if awsCfg.Region == "" {
+		return nil, fmt.Errorf("no region set in [s3] or the environment")
 	}
 
-	s3Client := s3.NewFromConfig(awsCfg)
+	s3Client := s3.NewFromConfig(awsCfg, func(o *s3.Options) {
+		if cfg.Endpoint != "" {
+			o.BaseEndpoint = aws.String(cfg.Endpoint)
+		}
+		o.UsePathStyle = cfg.PathStyle
+	})
 
 	return &S3Client{
-		S3:     s3Client,
-		Bucket: cfg.Bucket,
+		S3:          s3Client,
+		Bucket:      cfg.Bucket,
+		putDefaults: s3.PutObjectInput{ACL: types.ObjectCannedACLPublicRead},
+	}, nil
+}
+
+// Get a client for where thumbnails are kept, sharing the connection to S3 with this one
+func (s *S3Client) Thumbnails(cfg config.S3ThumbnailConfig) (*S3Client, error) {
+	thumbs := &S3Client{
+		S3:     s.S3,
+		Bucket: s.Bucket,
+		Prefix: cfg.Prefix,
+	}
+	if cfg.Bucket != "" {
+		thumbs.Bucket = cfg.Bucket
+	}
+
+	if cfg.ACL != "" && cfg.ACL != config.S3ACLNone {
+		acl := types.ObjectCannedACL(cfg.ACL)
+		if !slices.Contains(acl.Values(), acl) {
+			return nil, fmt.Errorf("unknown thumbnail acl %q", cfg.ACL)
+		}
+		thumbs.putDefaults.ACL = acl
+	}
+	if cfg.StorageClass != "" {
+		// not checked against the SDK's list, since S3 compatible stores have their own classes
+		thumbs.putDefaults.StorageClass = types.StorageClass(cfg.StorageClass)
+	}
+	if cfg.CacheControl != "" {
+		thumbs.putDefaults.CacheControl = aws.String(cfg.CacheControl)
 	}
+	if cfg.ContentDisposition != "" {
+		thumbs.putDefaults.ContentDisposition = aws.String(cfg.ContentDisposition)
+	}
+	if len(cfg.Tags) > 0 {
+		tags := url.Values{}
+		for _, tag := range cfg.Tags {
+			key, value, _ := strings.Cut(tag, "=")
+			tags.Add(key, value)
+		}
+		thumbs.putDefaults.Tagging = aws.String(tags.Encode())
+	}
+
+	return thumbs, nil
 }
 
-// Get an object from S3 returning the metadata about the file, or an error
-func (s *S3Client) GetObject(ctx context.Context, key string) (*models.ImageResponse, error) {
+// Build the HTTP client for S3, with the certificate checks from the config
+func s3HTTPClient(cfg config.S3Config) (*awshttp.BuildableClient, error) {
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: !cfg.TLSVerify,
+	}
+
+	if cfg.CAFile != "" {
+		pem, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading ca_file: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("ca_file %s has no certificates in it", cfg.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if !cfg.TLSVerify {
+		log.Printf("WARNING: not verifying the certificate of the S3 endpoint")
+	}
+
+	return awshttp.NewBuildableClient().WithTransportOptions(func(t *http.Transport) {
+		t.TLSClientConfig = tlsConfig
+	}), nil
+}
+
+// Get an object from S3 returning the metadata about the file, or an error. The body is
+// not read here; it is streamed from S3 and the caller must close it. If br is not nil
+// only that range of the object is requested
+func (s *S3Client) Get(ctx context.Context, key string, br *models.ByteRange) (*models.ImageResponse, error) {
 	input := &s3.GetObjectInput{
 		Bucket: &s.Bucket,
-		Key:    &key,
+		Key:    aws.String(s.Prefix + key),
 	}
-
-	result, err := s.S3.GetObject(ctx, input)
-	if err != nil {
-		return nil, err
+	if br != nil {
+		rng := br.Header()
+		input.Range = &rng
 	}
-	defer result.Body.Close()
 
-	data, err := io.ReadAll(result.Body)
+	result, err := s.S3.GetObject(ctx, input)
 	if err != nil {
-		return nil, err
+		return nil, translateError(err)
 	}
 
 	resp := &models.ImageResponse{
-		Data: data,
+		Body: result.Body,
 	}
 
 	if result.ContentType != nil {
@@ -80,6 +188,15 @@ func (s *S3Client) GetObject(ctx context.Context, key string) (*models.ImageResp
 	if result.LastModified != nil {
 		resp.LastModified = *result.LastModified
 	}
+	if result.ContentDisposition != nil {
+		resp.ContentDisposition = *result.ContentDisposition
+	}
+	if result.ContentRange != nil {
+		resp.ContentRange = *result.ContentRange
+	}
+	if len(result.Metadata) > 0 {
+		resp.Metadata = result.Metadata
+	}
 
 	return resp, nil
 }
@@ -87,20 +204,18 @@ func (s *S3Client) GetObject(ctx context.Context, key string) (*models.ImageResp
 // Send a HEAD request to S3, so that we can get the data about the object
 // this allows us to signal to the browser that their cached copy is fine to use
 // and avoids us having to send a full GET to S3 which is more expensive
-func (s *S3Client) HeadObject(ctx context.Context, key string) (*models.ImageResponse, error) {
+func (s *S3Client) Head(ctx context.Context, key string) (*models.ImageResponse, error) {
 	input := &s3.HeadObjectInput{
 		Bucket: &s.Bucket,
-		Key:    &key,
+		Key:    aws.String(s.Prefix + key),
 	}
 
 	result, err := s.S3.HeadObject(ctx, input)
 	if err != nil {
-		return nil, err
+		return nil, translateError(err)
 	}
 
-	resp := &models.ImageResponse{
-		Data: nil,
-	}
+	resp := &models.ImageResponse{}
 
 	if result.ContentType != nil {
 		resp.ContentType = *result.ContentType
@@ -117,24 +232,95 @@ func (s *S3Client) HeadObject(ctx context.Context, key string) (*models.ImageRes
 	if result.ContentDisposition != nil {
 		resp.ContentDisposition = *result.ContentDisposition
 	}
+	if len(result.Metadata) > 0 {
+		resp.Metadata = result.Metadata
+	}
 
 	return resp, nil
 }
 
 // Put an object (thumb) into S3, mainly a wrapper around the existing s3 client
-func (s *S3Client) PutObject(ctx context.Context, key string, data []byte, contentType string) error {
-	input := &s3.PutObjectInput{
-		Bucket:      &s.Bucket,
-		Key:         &key,
-		Body:        bytes.NewReader(data),
-		ContentType: &contentType,
-		ACL:         "public-read",
+func (s *S3Client) Put(ctx context.Context, key string, data []byte, opts PutOptions) error {
+	input := s.putDefaults
+	input.Bucket = &s.Bucket
+	input.Key = aws.String(s.Prefix + key)
+	input.Body = bytes.NewReader(data)
+	input.ContentType = &opts.ContentType
+	input.Metadata = opts.Metadata
+
+	_, err := s.S3.PutObject(ctx, &input)
+	if err != nil {
+		return translateError(err)
+	}
+
+	return nil
+}
+
+// Delete an object from S3; S3 doesn't complain if the object doesn't exist
+func (s *S3Client) Delete(ctx context.Context, key string) error {
+	input := &s3.DeleteObjectInput{
+		Bucket: &s.Bucket,
+		Key:    aws.String(s.Prefix + key),
 	}
 
-	_, err := s.S3.PutObject(ctx, input)
+	_, err := s.S3.DeleteObject(ctx, input)
 	if err != nil {
-		return err
+		return translateError(err)
 	}
 
 	return nil
 }
+
+// List a page of objects under a prefix. We page with StartAfter rather than S3's continuation
+// token so that the cursor is just a key, which can be resumed later or against another backend
+func (s *S3Client) List(ctx context.Context, prefix, cursor string, limit int) (*ListPage, error) {
+	input := &s3.ListObjectsV2Input{
+		Bucket: &s.Bucket,
+		Prefix: aws.String(s.Prefix + prefix),
+	}
+	if cursor != "" {
+		input.StartAfter = aws.String(s.Prefix + cursor)
+	}
+	if limit > 0 {
+		input.MaxKeys = aws.Int32(int32(min(limit, 1000)))
+	}
+
+	result, err := s.S3.ListObjectsV2(ctx, input)
+	if err != nil {
+		return nil, translateError(err)
+	}
+
+	page := &ListPage{}
+	for _, obj := range result.Contents {
+		info := ObjectInfo{Key: strings.TrimPrefix(aws.ToString(obj.Key), s.Prefix), ETag: aws.ToString(obj.ETag)}
+		if obj.Size != nil {
+			info.Size = *obj.Size
+		}
+		if obj.LastModified != nil {
+			info.LastModified = *obj.LastModified
+		}
+		page.Objects = append(page.Objects, info)
+	}
+
+	if aws.ToBool(result.IsTruncated) && len(page.Objects) > 0 {
+		page.NextCursor = page.Objects[len(page.Objects)-1].Key
+	}
+
+	return page, nil
+}
+
+// Turn the errors S3 uses for missing objects and bad ranges into our own, so that nothing
+// outside this file needs to understand the AWS SDK's errors (since the S3 api is weird)
+func translateError(err error) error {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.ErrorCode() {
+		// HEAD responses have no body, so we only get the status text
+		case "NoSuchKey", "NotFound":
+			return ErrObjectNotFound
+		case "InvalidRange":
+			return ErrInvalidRange
+		}
+	}
+	return err
+}
@@ -0,0 +1,222 @@
+package storage
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"maps"
+	"sync"
+	"time"
+
+	"github.com/telepedia/thumbra/models"
+)
+
+// A local tier in front of a backend that keeps copies of the objects most recently read from
+// or written to it in memory, and serves them while the backend's circuit breaker is open, so
+// that existing thumbnails stay up through an outage. The copies may be out of date, but an old
+// thumbnail is better than an error; they are never used while the backend is answering
+type Stale struct {
+	Backend
+	cache *staleCache
+}
+
+// Wrap a backend with a stale cache of up to size bytes
+func NewStale(backend Backend, size int64) *Stale {
+	return &Stale{Backend: backend, cache: newStaleCache(size)}
+}
+
+func (s *Stale) Get(ctx context.Context, key string, br *models.ByteRange) (*models.ImageResponse, error) {
+	obj, err := s.Backend.Get(ctx, key, br)
+	if err == nil {
+		// only a whole object can be kept
+		if br == nil && obj.ContentRange == "" && obj.Length >= 0 && s.cache.fits(obj.Length) {
+			obj.Body = &staleBody{ReadCloser: obj.Body, obj: *obj, key: key, cache: s.cache}
+		}
+		return obj, nil
+	}
+	if !errors.Is(err, ErrBackendUnavailable) {
+		return nil, err
+	}
+
+	entry, ok := s.cache.get(key)
+	if !ok {
+		return nil, err
+	}
+	log.Printf("serving a stale copy of %s: %v", key, err)
+
+	resp := entry.response()
+	data := entry.data
+	if br != nil {
+		if br.Start >= int64(len(data)) {
+			return nil, ErrInvalidRange
+		}
+		end := min(br.Start+br.Length, int64(len(data)))
+		resp.ContentRange = (&models.ByteRange{Start: br.Start, Length: end - br.Start}).ContentRange(int64(len(data)))
+		data = data[br.Start:end]
+		resp.Length = int64(len(data))
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(data))
+	return resp, nil
+}
+
+func (s *Stale) Head(ctx context.Context, key string) (*models.ImageResponse, error) {
+	obj, err := s.Backend.Head(ctx, key)
+	if err == nil || !errors.Is(err, ErrBackendUnavailable) {
+		return obj, err
+	}
+
+	entry, ok := s.cache.get(key)
+	if !ok {
+		return nil, err
+	}
+	return entry.response(), nil
+}
+
+func (s *Stale) Put(ctx context.Context, key string, data []byte, opts PutOptions) error {
+	if err := s.Backend.Put(ctx, key, data, opts); err != nil {
+		return err
+	}
+
+	if s.cache.fits(int64(len(data))) {
+		s.cache.add(key, &staleEntry{
+			data:         bytes.Clone(data),
+			contentType:  opts.ContentType,
+			etag:         md5ETag(data),
+			lastModified: time.Now().UTC().Truncate(time.Second),
+			metadata:     maps.Clone(opts.Metadata),
+		})
+	}
+	return nil
+}
+
+func (s *Stale) Delete(ctx context.Context, key string) error {
+	// even if the delete fails, it was meant to be gone, so don't bring it back in an outage
+	s.cache.remove(key)
+	return s.Backend.Delete(ctx, key)
+}
+
+// Keeps a copy of an object as it is read, and adds it to the cache once it has been read to the end
+type staleBody struct {
+	io.ReadCloser
+	obj   models.ImageResponse
+	key   string
+	cache *staleCache
+
+	buf      bytes.Buffer
+	complete bool
+}
+
+func (sb *staleBody) Read(p []byte) (int, error) {
+	n, err := sb.ReadCloser.Read(p)
+	sb.buf.Write(p[:n])
+	if err == io.EOF {
+		sb.complete = true
+	}
+	return n, err
+}
+
+func (sb *staleBody) Close() error {
+	err := sb.ReadCloser.Close()
+
+	if sb.complete && int64(sb.buf.Len()) == sb.obj.Length {
+		sb.cache.add(sb.key, &staleEntry{
+			data:         sb.buf.Bytes(),
+			contentType:  sb.obj.ContentType,
+			etag:         sb.obj.ETag,
+			lastModified: sb.obj.LastModified,
+			metadata:     sb.obj.Metadata,
+		})
+	}
+
+	return err
+}
+
+type staleEntry struct {
+	key          string
+	data         []byte
+	contentType  string
+	etag         string
+	lastModified time.Time
+	metadata     map[string]string
+}
+
+func (e *staleEntry) response() *models.ImageResponse {
+	return &models.ImageResponse{
+		ContentType:  e.contentType,
+		Length:       int64(len(e.data)),
+		ETag:         e.etag,
+		LastModified: e.lastModified,
+		Metadata:     maps.Clone(e.metadata),
+	}
+}
+
+// An LRU cache of objects, limited by their total size rather than how many there are
+type staleCache struct {
+	mu      sync.Mutex
+	size    int64
+	used    int64
+	entries map[string]*list.Element
+	order   *list.List
+}
+
+func newStaleCache(size int64) *staleCache {
+	return &staleCache{
+		size:    size,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// Whether an object is small enough to keep; nothing bigger than a tenth of the cache is
+// kept, so that one big object can't push out lots of thumbnails
+func (c *staleCache) fits(length int64) bool {
+	return length <= c.size/10
+}
+
+func (c *staleCache) get(key string) (*staleEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(el)
+	return el.Value.(*staleEntry), true
+}
+
+// Add (or replace) an object, evicting the least recently used objects until there is room
+func (c *staleCache) add(key string, entry *staleEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry.key = key
+	if el, ok := c.entries[key]; ok {
+		c.used -= int64(len(el.Value.(*staleEntry).data))
+		c.order.Remove(el)
+	}
+	c.entries[key] = c.order.PushFront(entry)
+	c.used += int64(len(entry.data))
+
+	for c.used > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		evicted := oldest.Value.(*staleEntry)
+		delete(c.entries, evicted.key)
+		c.used -= int64(len(evicted.data))
+	}
+}
+
+func (c *staleCache) remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[key]; ok {
+		c.order.Remove(el)
+		delete(c.entries, key)
+		c.used -= int64(len(el.Value.(*staleEntry).data))
+	}
+}
@@ -0,0 +1,387 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/telepedia/thumbra/config"
+	"github.com/telepedia/thumbra/models"
+)
+
+// The zones that MediaWiki's SwiftFileBackend keeps in their own containers. Originals and
+// their archived revisions are in the public zone, and thumbnails in the thumb zone
+const (
+	swiftZonePublic = "public"
+	swiftZoneThumb  = "thumb"
+)
+
+// the most objects Swift will list in one request
+const swiftListLimit = 10000
+
+// the format of last_modified in Swift's JSON listings, which is always UTC
+const swiftTimeLayout = "2006-01-02T15:04:05.999999"
+
+// user metadata is kept in headers with this prefix, which Swift returns with any case
+const swiftMetaPrefix = "X-Object-Meta-"
+
+// A backend for OpenStack Swift laid out the way MediaWiki's SwiftFileBackend does it, with a
+// container per wiki and zone rather than a prefix per wiki, ie metawiki/a/a0/Foo.png is a/a0/Foo.png
+// in metawiki-local-public, and metawiki/thumb/a/a0/Foo.png/100px-Foo.png is a/a0/Foo.png/100px-Foo.png
+// in metawiki-local-thumb. Only plain HTTP is used, so it can be pointed at anything that speaks the
+// Swift API, including a stand-in server for testing
+type Swift struct {
+	auth       *swiftAuth
+	client     *http.Client
+	containers string
+}
+
+// the fields of an object in a JSON container listing that we use
+type swiftObject struct {
+	Name         string `json:"name"`
+	Bytes        int64  `json:"bytes"`
+	Hash         string `json:"hash"`
+	LastModified string `json:"last_modified"`
+}
+
+func NewSwift(cfg config.SwiftConfig) *Swift {
+	// there is no overall timeout; every request has a deadline from its context
+	client := &http.Client{}
+
+	return &Swift{
+		auth:       &swiftAuth{cfg: cfg, client: client},
+		client:     client,
+		containers: cfg.Containers,
+	}
+}
+
+func (s *Swift) Get(ctx context.Context, key string, br *models.ByteRange) (*models.ImageResponse, error) {
+	container, object, err := s.locate(key)
+	if err != nil {
+		return nil, ErrObjectNotFound
+	}
+
+	header := http.Header{}
+	if br != nil {
+		header.Set("Range", br.Header())
+	}
+
+	resp, err := s.do(ctx, http.MethodGet, container, object, nil, header, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusPartialContent:
+		obj := swiftResponse(resp)
+		obj.Body = resp.Body
+		return obj, nil
+	case http.StatusNotFound:
+		resp.Body.Close()
+		return nil, ErrObjectNotFound
+	case http.StatusRequestedRangeNotSatisfiable:
+		resp.Body.Close()
+		return nil, ErrInvalidRange
+	default:
+		resp.Body.Close()
+		return nil, swiftError(resp)
+	}
+}
+
+func (s *Swift) Head(ctx context.Context, key string) (*models.ImageResponse, error) {
+	container, object, err := s.locate(key)
+	if err != nil {
+		return nil, ErrObjectNotFound
+	}
+
+	resp, err := s.do(ctx, http.MethodHead, container, object, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNoContent:
+		return swiftResponse(resp), nil
+	case http.StatusNotFound:
+		return nil, ErrObjectNotFound
+	default:
+		return nil, swiftError(resp)
+	}
+}
+
+// Upload an object. The containers are MediaWiki's, so we expect them to exist already
+func (s *Swift) Put(ctx context.Context, key string, data []byte, opts PutOptions) error {
+	container, object, err := s.locate(key)
+	if err != nil {
+		return err
+	}
+
+	sum := md5.Sum(data)
+	header := http.Header{}
+	header.Set("Content-Type", opts.ContentType)
+	// Swift checks the upload against this and refuses it if it doesn't match
+	header.Set("ETag", hex.EncodeToString(sum[:]))
+	for name, value := range opts.Metadata {
+		header.Set(swiftMetaPrefix+name, value)
+	}
+
+	resp, err := s.do(ctx, http.MethodPut, container, object, nil, header, data)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		return swiftError(resp)
+	}
+	return nil
+}
+
+func (s *Swift) Delete(ctx context.Context, key string) error {
+	container, object, err := s.locate(key)
+	if err != nil {
+		return err
+	}
+
+	resp, err := s.do(ctx, http.MethodDelete, container, object, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 && resp.StatusCode != http.StatusNotFound {
+		return swiftError(resp)
+	}
+	return nil
+}
+
+// List the objects under a prefix. A prefix for a whole wiki covers both of its containers, so
+// each container that the prefix (and cursor) reaches into is listed, and the results merged
+// back into key order. The prefix has to name a wiki, since we can't list every container
+func (s *Swift) List(ctx context.Context, prefix, cursor string, limit int) (*ListPage, error) {
+	wiki, _, ok := strings.Cut(prefix, "/")
+	if !ok || wiki == "" {
+		return nil, fmt.Errorf("cannot list across wikis when each wiki has its own containers")
+	}
+
+	perZone := swiftListLimit
+	if limit > 0 {
+		perZone = min(limit, swiftListLimit)
+	}
+
+	page := &ListPage{}
+	more := false
+
+	zones := []struct{ name, keyPrefix string }{
+		{swiftZonePublic, wiki + "/"},
+		{swiftZoneThumb, wiki + "/thumb/"},
+	}
+	for _, zone := range zones {
+		objectPrefix, ok := zonePrefix(prefix, zone.keyPrefix)
+		if !ok || (zone.name == swiftZonePublic && strings.HasPrefix(objectPrefix, swiftZoneThumb+"/")) {
+			continue
+		}
+		marker, done := zoneMarker(cursor, zone.keyPrefix)
+		if done {
+			continue
+		}
+
+		objects, err := s.listContainer(ctx, s.container(wiki, zone.name), objectPrefix, marker, perZone)
+		if err != nil {
+			return nil, err
+		}
+		if len(objects) == perZone {
+			more = true
+		}
+
+		for _, obj := range objects {
+			info := ObjectInfo{
+				Key:  zone.keyPrefix + obj.Name,
+				Size: obj.Bytes,
+				ETag: `"` + obj.Hash + `"`,
+			}
+			if t, err := time.Parse(swiftTimeLayout, obj.LastModified); err == nil {
+				info.LastModified = t.UTC()
+			}
+			page.Objects = append(page.Objects, info)
+		}
+	}
+
+	// the first page of each container holds the first perZone keys overall, as the ones
+	// that weren't listed come after everything listed from the same container
+	sort.Slice(page.Objects, func(i, j int) bool { return page.Objects[i].Key < page.Objects[j].Key })
+	if len(page.Objects) > perZone {
+		page.Objects = page.Objects[:perZone]
+		more = true
+	}
+	if more && len(page.Objects) > 0 {
+		page.NextCursor = page.Objects[len(page.Objects)-1].Key
+	}
+
+	return page, nil
+}
+
+// Get one page of a container listing; a container that doesn't exist is empty
+func (s *Swift) listContainer(ctx context.Context, container, prefix, marker string, limit int) ([]swiftObject, error) {
+	query := url.Values{}
+	query.Set("format", "json")
+	query.Set("limit", fmt.Sprint(limit))
+	if prefix != "" {
+		query.Set("prefix", prefix)
+	}
+	if marker != "" {
+		query.Set("marker", marker)
+	}
+
+	resp, err := s.do(ctx, http.MethodGet, container, "", query, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNoContent, http.StatusNotFound:
+		return nil, nil
+	default:
+		return nil, swiftError(resp)
+	}
+
+	var objects []swiftObject
+	if err := json.NewDecoder(resp.Body).Decode(&objects); err != nil {
+		return nil, fmt.Errorf("decoding listing of %s: %w", container, err)
+	}
+	return objects, nil
+}
+
+// Send a request to Swift. If the token is rejected (ie it was revoked before it expired)
+// a new one is fetched and the request is tried once more
+func (s *Swift) do(ctx context.Context, method, container, object string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		token, err := s.auth.get(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		target := token.storageURL + "/" + url.PathEscape(container)
+		if object != "" {
+			target += "/" + escapeObject(object)
+		}
+		if query != nil {
+			target += "?" + query.Encode()
+		}
+
+		var reader io.Reader
+		if method == http.MethodPut {
+			reader = bytes.NewReader(body)
+		}
+		req, err := http.NewRequestWithContext(ctx, method, target, reader)
+		if err != nil {
+			return nil, err
+		}
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		req.Header.Set("X-Auth-Token", token.token)
+
+		resp, err := s.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode == http.StatusUnauthorized && attempt == 0 {
+			resp.Body.Close()
+			s.auth.invalidate(token)
+			continue
+		}
+		return resp, nil
+	}
+}
+
+// Split a key into its container and object name
+func (s *Swift) locate(key string) (string, string, error) {
+	wiki, object, ok := strings.Cut(key, "/")
+	if !ok || wiki == "" || object == "" {
+		return "", "", fmt.Errorf("invalid key %q", key)
+	}
+
+	if thumb, ok := strings.CutPrefix(object, swiftZoneThumb+"/"); ok {
+		return s.container(wiki, swiftZoneThumb), thumb, nil
+	}
+	return s.container(wiki, swiftZonePublic), object, nil
+}
+
+func (s *Swift) container(wiki, zone string) string {
+	return strings.NewReplacer("{wiki}", wiki, "{zone}", zone).Replace(s.containers)
+}
+
+// Work out what to list in a zone's container for a prefix; false if the prefix is outside the zone
+func zonePrefix(prefix, keyPrefix string) (string, bool) {
+	if strings.HasPrefix(prefix, keyPrefix) {
+		return prefix[len(keyPrefix):], true
+	}
+	if strings.HasPrefix(keyPrefix, prefix) {
+		return "", true
+	}
+	return "", false
+}
+
+// Work out where to start listing a zone's container from a cursor; true if the cursor
+// is already past everything in the zone
+func zoneMarker(cursor, keyPrefix string) (string, bool) {
+	if strings.HasPrefix(cursor, keyPrefix) {
+		return cursor[len(keyPrefix):], false
+	}
+	return "", cursor > keyPrefix
+}
+
+// Escape each part of an object name, keeping the slashes between them
+func escapeObject(object string) string {
+	parts := strings.Split(object, "/")
+	for i, part := range parts {
+		parts[i] = url.PathEscape(part)
+	}
+	return strings.Join(parts, "/")
+}
+
+// Describe an object from the headers of a GET or HEAD
+func swiftResponse(resp *http.Response) *models.ImageResponse {
+	obj := &models.ImageResponse{
+		ContentType:        resp.Header.Get("Content-Type"),
+		Length:             resp.ContentLength,
+		ContentDisposition: resp.Header.Get("Content-Disposition"),
+		ContentRange:       resp.Header.Get("Content-Range"),
+	}
+
+	// Swift doesn't quote its ETags, but everything else (and HTTP) does
+	if etag := resp.Header.Get("ETag"); etag != "" {
+		obj.ETag = `"` + strings.Trim(etag, `"`) + `"`
+	}
+	if lastModified, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		obj.LastModified = lastModified
+	}
+	for name, values := range resp.Header {
+		if len(name) > len(swiftMetaPrefix) && strings.EqualFold(name[:len(swiftMetaPrefix)], swiftMetaPrefix) {
+			if obj.Metadata == nil {
+				obj.Metadata = make(map[string]string)
+			}
+			obj.Metadata[strings.ToLower(name[len(swiftMetaPrefix):])] = values[0]
+		}
+	}
+
+	return obj
+}
+
+func swiftError(resp *http.Response) error {
+	return fmt.Errorf("swift %s %s returned %s", resp.Request.Method, resp.Request.URL.Path, resp.Status)
+}
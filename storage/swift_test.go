@@ -0,0 +1,477 @@
+package storage
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/telepedia/thumbra/config"
+	"github.com/telepedia/thumbra/models"
+)
+
+// where the fake server keeps an account's containers
+const fakeSwiftAccount = "/v1/AUTH_test"
+
+type fakeSwiftObject struct {
+	data        []byte
+	contentType string
+	metadata    http.Header
+}
+
+// A stand-in for Swift with both kinds of auth in front of it. Only the latest token it has
+// issued is accepted, so a test can revoke a token by issuing another behind the backend's back
+type fakeSwift struct {
+	t      *testing.T
+	server *httptest.Server
+
+	mu         sync.Mutex
+	containers map[string]map[string]fakeSwiftObject
+	token      string
+	issued     int
+	// the body of the last Keystone auth request
+	keystoneAuth map[string]any
+}
+
+func newFakeSwift(t *testing.T, containers ...string) *fakeSwift {
+	f := &fakeSwift{t: t, containers: make(map[string]map[string]fakeSwiftObject)}
+	for _, name := range containers {
+		f.containers[name] = make(map[string]fakeSwiftObject)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /auth/v1.0", f.tempAuth)
+	mux.HandleFunc("POST /v3/auth/tokens", f.keystone)
+	mux.HandleFunc(fakeSwiftAccount+"/", f.storage)
+	f.server = httptest.NewServer(mux)
+	t.Cleanup(f.server.Close)
+	return f
+}
+
+// Issue a new token, which replaces any that was issued before
+func (f *fakeSwift) issue() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.issued++
+	f.token = "token" + strconv.Itoa(f.issued)
+	return f.token
+}
+
+func (f *fakeSwift) tokensIssued() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.issued
+}
+
+func (f *fakeSwift) tempAuth(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("X-Auth-User") != "test:tester" || r.Header.Get("X-Auth-Key") != "secret" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	w.Header().Set("X-Auth-Token", f.issue())
+	w.Header().Set("X-Storage-Url", f.server.URL+fakeSwiftAccount)
+	w.Header().Set("X-Auth-Token-Expires", "86400")
+}
+
+func (f *fakeSwift) keystone(w http.ResponseWriter, r *http.Request) {
+	var body map[string]any
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	f.mu.Lock()
+	f.keystoneAuth = body
+	f.mu.Unlock()
+
+	w.Header().Set("X-Subject-Token", f.issue())
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprintf(w, `{"token": {"expires_at": %q, "catalog": [
+		{"type": "identity", "endpoints": [{"interface": "public", "region": "east", "url": "http://keystone.invalid"}]},
+		{"type": "object-store", "endpoints": [
+			{"interface": "internal", "region": "east", "url": "http://internal.invalid"},
+			{"interface": "public", "region": "west", "url": "http://west.invalid"},
+			{"interface": "public", "region": "east", "url": %q}
+		]}
+	]}}`, time.Now().Add(time.Hour).UTC().Format(time.RFC3339), f.server.URL+fakeSwiftAccount)
+}
+
+func (f *fakeSwift) storage(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if r.Header.Get("X-Auth-Token") != f.token {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	container, name, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, fakeSwiftAccount+"/"), "/")
+	objects, ok := f.containers[container]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if name == "" {
+		f.list(w, r, objects)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		data, _ := io.ReadAll(r.Body)
+		if sum := md5.Sum(data); r.Header.Get("ETag") != hex.EncodeToString(sum[:]) {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			return
+		}
+		metadata := http.Header{}
+		for header, values := range r.Header {
+			if strings.HasPrefix(header, swiftMetaPrefix) {
+				metadata[header] = values
+			}
+		}
+		objects[name] = fakeSwiftObject{data: data, contentType: r.Header.Get("Content-Type"), metadata: metadata}
+		w.WriteHeader(http.StatusCreated)
+	case http.MethodDelete:
+		if _, ok := objects[name]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		delete(objects, name)
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodGet, http.MethodHead:
+		obj, ok := objects[name]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		for header, values := range obj.metadata {
+			w.Header()[header] = values
+		}
+		sum := md5.Sum(obj.data)
+		w.Header().Set("ETag", hex.EncodeToString(sum[:]))
+		w.Header().Set("Content-Type", obj.contentType)
+		http.ServeContent(w, r, "", time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC), strings.NewReader(string(obj.data)))
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// A JSON container listing, in name order after the marker, as Swift gives it
+func (f *fakeSwift) list(w http.ResponseWriter, r *http.Request, objects map[string]fakeSwiftObject) {
+	query := r.URL.Query()
+	if query.Get("format") != "json" {
+		f.t.Errorf("listing asked for format %q, not json", query.Get("format"))
+	}
+
+	var names []string
+	for name := range objects {
+		if strings.HasPrefix(name, query.Get("prefix")) && name > query.Get("marker") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	if limit, err := strconv.Atoi(query.Get("limit")); err == nil && len(names) > limit {
+		names = names[:limit]
+	}
+
+	listing := []swiftObject{}
+	for _, name := range names {
+		sum := md5.Sum(objects[name].data)
+		listing = append(listing, swiftObject{
+			Name:         name,
+			Bytes:        int64(len(objects[name].data)),
+			Hash:         hex.EncodeToString(sum[:]),
+			LastModified: "2024-05-06T07:08:09.123456",
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(listing)
+}
+
+func (f *fakeSwift) tempAuthConfig() config.SwiftConfig {
+	return config.SwiftConfig{
+		Auth:       config.SwiftAuthTempAuth,
+		AuthURL:    f.server.URL + "/auth/v1.0",
+		User:       "test:tester",
+		Password:   "secret",
+		Containers: "{wiki}-local-{zone}",
+	}
+}
+
+func (f *fakeSwift) keystoneConfig() config.SwiftConfig {
+	return config.SwiftConfig{
+		Auth:          config.SwiftAuthKeystone,
+		AuthURL:       f.server.URL + "/v3",
+		User:          "thumbra",
+		Password:      "secret",
+		UserDomain:    "Default",
+		Project:       "media",
+		ProjectDomain: "Default",
+		Region:        "east",
+		Interface:     "public",
+		Containers:    "{wiki}-local-{zone}",
+	}
+}
+
+func TestSwiftTempAuth(t *testing.T) {
+	f := newFakeSwift(t, "metawiki-local-public")
+	f.containers["metawiki-local-public"]["a/ab/Foo.png"] = fakeSwiftObject{data: []byte("foo"), contentType: "image/png"}
+	s := NewSwift(f.tempAuthConfig())
+	ctx := context.Background()
+
+	for range 2 {
+		if _, err := s.Head(ctx, "metawiki/a/ab/Foo.png"); err != nil {
+			t.Fatalf("Head: %v", err)
+		}
+	}
+	if issued := f.tokensIssued(); issued != 1 {
+		t.Errorf("got %d tokens, want 1 to be reused", issued)
+	}
+}
+
+func TestSwiftTempAuthRejected(t *testing.T) {
+	f := newFakeSwift(t, "metawiki-local-public")
+	cfg := f.tempAuthConfig()
+	cfg.Password = "wrong"
+
+	_, err := NewSwift(cfg).Head(context.Background(), "metawiki/a/ab/Foo.png")
+	if err == nil || errors.Is(err, ErrObjectNotFound) {
+		t.Fatalf("Head with bad credentials: got %v, want an auth error", err)
+	}
+}
+
+func TestSwiftKeystone(t *testing.T) {
+	f := newFakeSwift(t, "metawiki-local-public")
+	f.containers["metawiki-local-public"]["a/ab/Foo.png"] = fakeSwiftObject{data: []byte("foo"), contentType: "image/png"}
+	s := NewSwift(f.keystoneConfig())
+
+	// the storage URL comes from the public object-store endpoint in the east region
+	if _, err := s.Head(context.Background(), "metawiki/a/ab/Foo.png"); err != nil {
+		t.Fatalf("Head: %v", err)
+	}
+
+	auth := f.keystoneAuth["auth"].(map[string]any)
+	identity := auth["identity"].(map[string]any)
+	if methods := identity["methods"].([]any); len(methods) != 1 || methods[0] != "password" {
+		t.Errorf("identity methods = %v, want [password]", methods)
+	}
+	user := identity["password"].(map[string]any)["user"].(map[string]any)
+	if user["name"] != "thumbra" || user["password"] != "secret" {
+		t.Errorf("user = %v, want thumbra with its password", user)
+	}
+	project := auth["scope"].(map[string]any)["project"].(map[string]any)
+	if project["name"] != "media" || project["domain"].(map[string]any)["name"] != "Default" {
+		t.Errorf("project scope = %v, want media in Default", project)
+	}
+}
+
+func TestSwiftKeystoneWithoutEndpoint(t *testing.T) {
+	f := newFakeSwift(t)
+	cfg := f.keystoneConfig()
+	cfg.Region = "north"
+
+	if _, err := NewSwift(cfg).Head(context.Background(), "metawiki/a/ab/Foo.png"); err == nil {
+		t.Fatal("Head with no endpoint in the catalog succeeded")
+	}
+}
+
+func TestSwiftReauthenticatesOnUnauthorized(t *testing.T) {
+	f := newFakeSwift(t, "metawiki-local-public")
+	f.containers["metawiki-local-public"]["a/ab/Foo.png"] = fakeSwiftObject{data: []byte("foo"), contentType: "image/png"}
+	s := NewSwift(f.tempAuthConfig())
+	ctx := context.Background()
+
+	if _, err := s.Head(ctx, "metawiki/a/ab/Foo.png"); err != nil {
+		t.Fatalf("Head: %v", err)
+	}
+
+	// revoke the backend's token before it expires
+	f.issue()
+
+	obj, err := s.Get(ctx, "metawiki/a/ab/Foo.png", nil)
+	if err != nil {
+		t.Fatalf("Get after the token was revoked: %v", err)
+	}
+	data, _ := io.ReadAll(obj.Body)
+	obj.Body.Close()
+	if string(data) != "foo" {
+		t.Errorf("Get = %q, want foo", data)
+	}
+	if issued := f.tokensIssued(); issued != 3 {
+		t.Errorf("got %d tokens, want 3 (the first, the revoking one, and a new one)", issued)
+	}
+}
+
+func TestSwiftObjects(t *testing.T) {
+	f := newFakeSwift(t, "metawiki-local-public", "metawiki-local-thumb")
+	s := NewSwift(f.tempAuthConfig())
+	ctx := context.Background()
+
+	original := "metawiki/a/ab/Foo bar%.png"
+	thumb := "metawiki/thumb/a/ab/Foo bar%.png/100px-Foo bar%.png"
+	if err := s.Put(ctx, original, []byte("original"), PutOptions{ContentType: "image/png"}); err != nil {
+		t.Fatalf("Put original: %v", err)
+	}
+	if err := s.Put(ctx, thumb, []byte("thumbnail"), PutOptions{
+		ContentType: "image/png",
+		Metadata:    map[string]string{"source-etag": `"abc"`},
+	}); err != nil {
+		t.Fatalf("Put thumbnail: %v", err)
+	}
+
+	// originals go in the public container and thumbnails in the thumb one, without the thumb/
+	if _, ok := f.containers["metawiki-local-public"]["a/ab/Foo bar%.png"]; !ok {
+		t.Errorf("original isn't in metawiki-local-public: %v", f.containers["metawiki-local-public"])
+	}
+	if _, ok := f.containers["metawiki-local-thumb"]["a/ab/Foo bar%.png/100px-Foo bar%.png"]; !ok {
+		t.Errorf("thumbnail isn't in metawiki-local-thumb: %v", f.containers["metawiki-local-thumb"])
+	}
+
+	head, err := s.Head(ctx, thumb)
+	if err != nil {
+		t.Fatalf("Head: %v", err)
+	}
+	sum := md5.Sum([]byte("thumbnail"))
+	if want := `"` + hex.EncodeToString(sum[:]) + `"`; head.ETag != want {
+		t.Errorf("ETag = %s, want %s", head.ETag, want)
+	}
+	if head.ContentType != "image/png" || head.Length != int64(len("thumbnail")) {
+		t.Errorf("Head = %s, %d bytes; want image/png, %d bytes", head.ContentType, head.Length, len("thumbnail"))
+	}
+	if !head.LastModified.Equal(time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC)) {
+		t.Errorf("LastModified = %v", head.LastModified)
+	}
+	if head.Metadata["source-etag"] != `"abc"` {
+		t.Errorf("Metadata = %v, want the source-etag", head.Metadata)
+	}
+
+	obj, err := s.Get(ctx, original, &models.ByteRange{Start: 2, Length: 3})
+	if err != nil {
+		t.Fatalf("Get range: %v", err)
+	}
+	data, _ := io.ReadAll(obj.Body)
+	obj.Body.Close()
+	if string(data) != "igi" || obj.ContentRange != "bytes 2-4/8" {
+		t.Errorf("Get range = %q (%s), want igi (bytes 2-4/8)", data, obj.ContentRange)
+	}
+
+	if err := s.Delete(ctx, thumb); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := s.Head(ctx, thumb); !errors.Is(err, ErrObjectNotFound) {
+		t.Errorf("Head after Delete: got %v, want ErrObjectNotFound", err)
+	}
+	// deleting something that is already gone is fine
+	if err := s.Delete(ctx, thumb); err != nil {
+		t.Errorf("Delete again: %v", err)
+	}
+}
+
+func TestSwiftNotFound(t *testing.T) {
+	f := newFakeSwift(t, "metawiki-local-public")
+	s := NewSwift(f.tempAuthConfig())
+	ctx := context.Background()
+
+	for _, key := range []string{
+		"metawiki/a/ab/Missing.png",
+		// a wiki without any containers
+		"otherwiki/a/ab/Missing.png",
+		// not a key at all
+		"metawiki",
+	} {
+		if _, err := s.Get(ctx, key, nil); !errors.Is(err, ErrObjectNotFound) {
+			t.Errorf("Get %s: got %v, want ErrObjectNotFound", key, err)
+		}
+		if _, err := s.Head(ctx, key); !errors.Is(err, ErrObjectNotFound) {
+			t.Errorf("Head %s: got %v, want ErrObjectNotFound", key, err)
+		}
+	}
+}
+
+func TestSwiftList(t *testing.T) {
+	f := newFakeSwift(t, "metawiki-local-public", "metawiki-local-thumb")
+	s := NewSwift(f.tempAuthConfig())
+	ctx := context.Background()
+
+	keys := []string{
+		"metawiki/a/ab/Foo.png",
+		"metawiki/archive/a/ab/20200101000000!Foo.png",
+		"metawiki/b/bc/Bar.png",
+		"metawiki/thumb/a/ab/Foo.png/100px-Foo.png",
+		"metawiki/thumb/a/ab/Foo.png/200px-Foo.png",
+		"metawiki/thumb/archive/a/ab/20200101000000!Foo.png/100px-Foo.png",
+		"metawiki/z/zz/Zed.png",
+	}
+	for _, key := range keys {
+		if err := s.Put(ctx, key, []byte(key), PutOptions{ContentType: "image/png"}); err != nil {
+			t.Fatalf("Put %s: %v", key, err)
+		}
+	}
+
+	tests := []struct {
+		prefix string
+		want   []string
+	}{
+		// both containers, merged back into key order
+		{"metawiki/", keys},
+		{"metawiki/thumb/", keys[3:6]},
+		{"metawiki/thumb/archive/", keys[5:6]},
+		{"metawiki/a/", keys[0:1]},
+		{"metawiki/t", keys[3:6]},
+	}
+	for _, test := range tests {
+		for _, limit := range []int{0, 1, 2, 3} {
+			var got []string
+			cursor := ""
+			for pages := 0; ; pages++ {
+				if pages > len(keys) {
+					t.Fatalf("List %s with limit %d doesn't end", test.prefix, limit)
+				}
+				page, err := s.List(ctx, test.prefix, cursor, limit)
+				if err != nil {
+					t.Fatalf("List %s: %v", test.prefix, err)
+				}
+				if limit > 0 && len(page.Objects) > limit {
+					t.Errorf("List %s gave %d objects, more than the limit of %d", test.prefix, len(page.Objects), limit)
+				}
+				for _, obj := range page.Objects {
+					got = append(got, obj.Key)
+				}
+				if cursor = page.NextCursor; cursor == "" {
+					break
+				}
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("List %s with limit %d = %v, want %v", test.prefix, limit, got, test.want)
+			}
+		}
+	}
+
+	page, err := s.List(ctx, "metawiki/thumb/a/", "", 0)
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	sum := md5.Sum([]byte(keys[3]))
+	obj := page.Objects[0]
+	if obj.ETag != `"`+hex.EncodeToString(sum[:])+`"` || obj.Size != int64(len(keys[3])) {
+		t.Errorf("listed %+v, want the object's quoted MD5 and size", obj)
+	}
+	if want := time.Date(2024, 5, 6, 7, 8, 9, 123456000, time.UTC); !obj.LastModified.Equal(want) {
+		t.Errorf("LastModified = %v, want %v", obj.LastModified, want)
+	}
+
+	if _, err := s.List(ctx, "", "", 0); err == nil {
+		t.Error("List across wikis succeeded")
+	}
+}
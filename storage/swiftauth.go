@@ -0,0 +1,209 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/telepedia/thumbra/config"
+)
+
+// get a new token this long before the old one expires, so that a request never starts
+// with a token that runs out part way through
+const swiftTokenMargin = 5 * time.Minute
+
+// how long to use a token for if the auth server doesn't say when it expires; TempAuth's
+// tokens last a day by default
+const swiftTokenLifetime = time.Hour
+
+// A token for Swift and the storage URL it is for
+type swiftToken struct {
+	token      string
+	storageURL string
+	expires    time.Time
+}
+
+// Gets tokens from Keystone or TempAuth, and keeps using the same one until it's about to
+// expire or Swift rejects it
+type swiftAuth struct {
+	cfg    config.SwiftConfig
+	client *http.Client
+
+	mu      sync.Mutex
+	current *swiftToken
+}
+
+// Get a valid token, authenticating if we don't have one
+func (a *swiftAuth) get(ctx context.Context) (*swiftToken, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.current != nil && time.Now().Before(a.current.expires.Add(-swiftTokenMargin)) {
+		return a.current, nil
+	}
+
+	var token *swiftToken
+	var err error
+	if a.cfg.Auth == config.SwiftAuthTempAuth {
+		token, err = a.tempAuth(ctx)
+	} else {
+		token, err = a.keystone(ctx)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("swift auth: %w", err)
+	}
+
+	if a.cfg.StorageURL != "" {
+		token.storageURL = a.cfg.StorageURL
+	}
+	token.storageURL = strings.TrimSuffix(token.storageURL, "/")
+
+	a.current = token
+	return token, nil
+}
+
+// Forget a token that Swift has rejected, so that the next request gets a new one. Only the
+// token that was rejected is forgotten, in case another request has already replaced it
+func (a *swiftAuth) invalidate(token *swiftToken) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.current == token {
+		a.current = nil
+	}
+}
+
+// TempAuth (and Swauth) is a GET with the credentials in headers, the token and
+// storage URL come back the same way
+func (a *swiftAuth) tempAuth(ctx context.Context) (*swiftToken, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, a.cfg.AuthURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Auth-User", a.cfg.User)
+	req.Header.Set("X-Auth-Key", a.cfg.Password)
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("tempauth returned %s", resp.Status)
+	}
+
+	token := &swiftToken{
+		token:      resp.Header.Get("X-Auth-Token"),
+		storageURL: resp.Header.Get("X-Storage-Url"),
+		expires:    time.Now().Add(swiftTokenLifetime),
+	}
+	if seconds, err := strconv.Atoi(resp.Header.Get("X-Auth-Token-Expires")); err == nil {
+		token.expires = time.Now().Add(time.Duration(seconds) * time.Second)
+	}
+	if token.token == "" || token.storageURL == "" {
+		return nil, fmt.Errorf("tempauth response is missing the token or storage url")
+	}
+
+	return token, nil
+}
+
+// the parts of a Keystone v3 token response we use
+type keystoneTokenResponse struct {
+	Token struct {
+		ExpiresAt time.Time `json:"expires_at"`
+		Catalog   []struct {
+			Type      string `json:"type"`
+			Endpoints []struct {
+				Interface string `json:"interface"`
+				Region    string `json:"region"`
+				URL       string `json:"url"`
+			} `json:"endpoints"`
+		} `json:"catalog"`
+	} `json:"token"`
+}
+
+// Get a project scoped token from Keystone v3 with a password, and find the object store in
+// the catalog that comes back with it
+func (a *swiftAuth) keystone(ctx context.Context) (*swiftToken, error) {
+	body := map[string]any{
+		"auth": map[string]any{
+			"identity": map[string]any{
+				"methods": []string{"password"},
+				"password": map[string]any{
+					"user": map[string]any{
+						"name":     a.cfg.User,
+						"password": a.cfg.Password,
+						"domain":   map[string]string{"name": a.cfg.UserDomain},
+					},
+				},
+			},
+			"scope": map[string]any{
+				"project": map[string]any{
+					"name":   a.cfg.Project,
+					"domain": map[string]string{"name": a.cfg.ProjectDomain},
+				},
+			},
+		},
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+
+	url := strings.TrimSuffix(a.cfg.AuthURL, "/") + "/auth/tokens"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		return nil, fmt.Errorf("keystone returned %s", resp.Status)
+	}
+
+	var result keystoneTokenResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("decoding keystone response: %w", err)
+	}
+
+	token := &swiftToken{
+		token:   resp.Header.Get("X-Subject-Token"),
+		expires: result.Token.ExpiresAt,
+	}
+	if token.token == "" {
+		return nil, fmt.Errorf("keystone response is missing the token")
+	}
+	if token.expires.IsZero() {
+		token.expires = time.Now().Add(swiftTokenLifetime)
+	}
+
+	for _, service := range result.Token.Catalog {
+		if service.Type != "object-store" {
+			continue
+		}
+		for _, endpoint := range service.Endpoints {
+			if endpoint.Interface == a.cfg.Interface && (a.cfg.Region == "" || endpoint.Region == a.cfg.Region) {
+				token.storageURL = endpoint.URL
+				break
+			}
+		}
+	}
+	if token.storageURL == "" && a.cfg.StorageURL == "" {
+		return nil, fmt.Errorf("no %s object-store endpoint in the keystone catalog", a.cfg.Interface)
+	}
+
+	return token, nil
+}
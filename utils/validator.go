@@ -2,6 +2,7 @@ package utils
 
 import (
 	"fmt"
+	"strconv"
 	"strings"
 
 	"github.com/telepedia/thumbra/models"
@@ -23,6 +24,10 @@ var SupportedThumbFormats = map[string]bool{
 	"png":  true,
 	"gif":  true,
 	"webp": true,
+	// converted to JPEG (TIFF) or PNG (BMP), as browsers can't show them
+	"tif":  true,
+	"tiff": true,
+	"bmp":  true,
 }
 
 // validate that the request is valid and correctly formed
@@ -77,7 +82,7 @@ func ValidateThumbnailRequest(req models.ThumbnailRequest) error {
 		return ErrInvalidRevision
 	}
 
-	if req.Width == "" {
+	if width, err := strconv.Atoi(req.Width); err != nil || width <= 0 {
 		return ErrInvalidWidth
 	}
 